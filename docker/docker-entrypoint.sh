@@ -1,2 +1 @@
-service ssh start
 exec msc $@
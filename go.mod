@@ -6,6 +6,7 @@ require (
 	github.com/alecthomas/kong v0.2.15
 	github.com/containerd/go-runc v0.0.0-20201020171139-16b287bc67d0
 	github.com/joho/godotenv v1.3.0
+	github.com/klauspost/compress v1.14.4
 	github.com/pkg/errors v0.9.1
 	github.com/pkg/sftp v1.12.0
 	github.com/rs/zerolog v1.20.0
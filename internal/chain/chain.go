@@ -8,10 +8,11 @@ import (
 	"github.com/rs/zerolog/log"
 
 	chain_node "github.com/Xarepo/msc-container-migration/internal/chain/node"
+	"github.com/Xarepo/msc-container-migration/internal/chunk"
 	"github.com/Xarepo/msc-container-migration/internal/dump"
-	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
 	"github.com/Xarepo/msc-container-migration/internal/remote_target"
-	"github.com/Xarepo/msc-container-migration/internal/sftp"
+	"github.com/Xarepo/msc-container-migration/internal/transport"
 )
 
 type DumpChain struct {
@@ -32,39 +33,85 @@ func (chain *DumpChain) Latest() *chain_node.ChainNode {
 
 // Add a dump to the end of the chain
 func (chain *DumpChain) Push(dump dump.Dump) {
-	newNode := chain_node.New(&dump, chain.latest, false)
+	newNode := chain_node.New(&dump, chain.latest)
 	chain.latest = newNode
 	chain.length += 1
 }
 
 // Transfers all dumps in the chain regardless of whether or not they have
 // been synced.
-func (chain *DumpChain) FullTransfer(target *remote_target.RemoteTarget) {
+// Stops at, and returns, the first failed transfer, as a
+// *transport.TransferError.
+func (chain *DumpChain) FullTransfer(target *remote_target.RemoteTarget) error {
 	log.Debug().
-		Str("Target", target.Host).
+		Str("Target", target.Id()).
+		Str("Transport", target.Transport).
 		Msg("Performing full transfer of chain to target")
+	t, err := transport.FromTarget(target)
+	if err != nil {
+		return errors.Wrap(err, "Failed to select transport")
+	}
 	next := chain.latest
 	for next != nil {
-		sftp.TransferDump(next, target)
-		next.SetSynced()
+		if err := chunk.TransferDump(t, next, target); err != nil {
+			return err
+		}
+		next.SetSynced(target.Id())
+		logSynced(next, target)
 		next = next.GetPrev()
 	}
+	return nil
 }
 
-// Transfers all dumps in the chain that has not previously been synced.
-func (chain *DumpChain) Sync(target *remote_target.RemoteTarget) {
+// Transfers all dumps in the chain that has not previously been synced to the
+// target.
+// Stops at, and returns, the first failed transfer, as a
+// *transport.TransferError. The dumps that were not transferred are left
+// unsynced, and will be retried on the next sync. The whole chain is walked
+// on every sync, as a dump may have failed to transfer after the dumps that
+// followed it were synced.
+func (chain *DumpChain) Sync(target *remote_target.RemoteTarget) error {
 	log.Debug().
-		Str("Target", target.Host).
+		Str("Target", target.Id()).
 		Int("FileTransferPort", target.FileTransferPort).
+		Str("Transport", target.Transport).
 		Msg("Syncing chain to target")
+	t, err := transport.FromTarget(target)
+	if err != nil {
+		return errors.Wrap(err, "Failed to select transport")
+	}
+	for next := chain.latest; next != nil; next = next.GetPrev() {
+		if next.IsSynced(target.Id()) {
+			continue
+		}
+		if err := chunk.TransferDump(t, next, target); err != nil {
+			return err
+		}
+		next.SetSynced(target.Id())
+		logSynced(next, target)
+	}
+	return nil
+}
+
+// Mark all dumps in the chain as not synced to the target, so that they are
+// transferred again on the next sync.
+func (chain *DumpChain) Unsync(target *remote_target.RemoteTarget) {
+	log.Debug().Str("Target", target.Id()).Msg("Marking chain as unsynced")
 	next := chain.latest
-	for next != nil && !next.IsSynced() {
-		sftp.TransferDump(next, target)
-		next.SetSynced()
+	for next != nil {
+		next.SetUnsynced(target.Id())
 		next = next.GetPrev()
 	}
 }
 
+func logSynced(node *chain_node.ChainNode, target *remote_target.RemoteTarget) {
+	log.Debug().
+		Str("Dump", node.Dump().Base()).
+		Str("Target", target.Id()).
+		Strs("SyncedTargets", node.SyncedTargets()).
+		Msg("Dump synced to target")
+}
+
 // Return the names of all the dumps in the chain.
 func (chain *DumpChain) GetNames() []string {
 	next := chain.latest
@@ -85,7 +132,17 @@ func (chain DumpChain) Length() int {
 // Uses the parent symlinks of the dump directories in order to recursively
 // reconstruct the chain and its nodes.
 // Stops when there is no parent symlink in the specified dump path.
+// Every dump of the chain is verified against its manifest, and an error is
+// returned if any of them is corrupt.
 func ReconstructChain(dumpPath string) ([]string, error) {
+	if err := manifest.Verify(dumpPath); err != nil {
+		return []string{}, errors.Wrapf(
+			err,
+			"Dump %s is corrupt",
+			path.Base(dumpPath),
+		)
+	}
+
 	linkPath := path.Join(dumpPath, "parent")
 	fi, err := os.Lstat(linkPath)
 	if err != nil {
@@ -100,7 +157,7 @@ func ReconstructChain(dumpPath string) ([]string, error) {
 		if err != nil {
 			return []string{dumpPath}, errors.Wrap(err, "Failed to read symlink")
 		}
-		parentDestAbs := path.Join(env.Getenv().DUMP_PATH, path.Base(parentDest))
+		parentDestAbs := path.Join(path.Dir(dumpPath), path.Base(parentDest))
 		res, err := ReconstructChain(parentDestAbs)
 		if err != nil {
 			return []string{}, err
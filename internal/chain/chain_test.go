@@ -0,0 +1,62 @@
+package chain
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+	"github.com/Xarepo/msc-container-migration/internal/transport"
+)
+
+// Create the directory of the dump, with a file and a manifest.
+func createDump(t *testing.T, d *dump.Dump) {
+	if err := os.MkdirAll(d.Path(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(d.Path(), "pages-1.img")
+	if err := ioutil.WriteFile(file, []byte(d.Base()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Write(d.Path()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A dump that fails to transfer after the dumps following it were synced must
+// be retried on the next sync.
+func TestSyncRetriesOlderDumps(t *testing.T) {
+	dir := dump.Dir(t.TempDir())
+	target := remote_target.RemoteTarget{
+		DumpPath:  t.TempDir(),
+		Transport: transport.Local,
+	}
+	p0, d1 := dir.FromString("p0"), dir.FromString("d1")
+	createDump(t, d1)
+	c := New()
+	c.Push(*p0)
+	c.Push(*d1)
+
+	// p0 does not exist yet, so it fails to transfer after d1 was synced.
+	if err := c.Sync(&target); err == nil {
+		t.Fatal("Sync() succeeded with a missing dump")
+	}
+	latest := c.Latest()
+	if !latest.IsSynced(target.Id()) || latest.GetPrev().IsSynced(target.Id()) {
+		t.Fatal("Expected only d1 to be synced")
+	}
+
+	createDump(t, p0)
+	if err := c.Sync(&target); err != nil {
+		t.Fatal(err)
+	}
+	if !latest.GetPrev().IsSynced(target.Id()) {
+		t.Fatal("p0 was not synced")
+	}
+	if err := manifest.Verify(path.Join(target.DumpPath, "p0")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,27 +1,63 @@
 package chain_node
 
-import "github.com/Xarepo/msc-container-migration/internal/dump"
+import (
+	"sort"
+	"sync"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+)
 
 type ChainNode struct {
-	el     *dump.Dump
-	prev   *ChainNode
-	synced bool
+	el   *dump.Dump
+	prev *ChainNode
+	// The ids of the targets that the dump has been synced to. Guarded by the
+	// lock, as the dump may be synced to several targets at once, e.g. to the
+	// destination of a migration and to a joining target.
+	synced map[string]bool
+	lock   sync.Mutex
 }
 
-func New(el *dump.Dump, prev *ChainNode, synced bool) *ChainNode {
-	return &ChainNode{el, prev, synced}
+func New(el *dump.Dump, prev *ChainNode) *ChainNode {
+	return &ChainNode{el: el, prev: prev, synced: map[string]bool{}}
 }
 
-func (node ChainNode) Dump() *dump.Dump {
+func (node *ChainNode) Dump() *dump.Dump {
 	return node.el
 }
 
-func (node *ChainNode) SetSynced() {
-	node.synced = true
+// Mark the dump as synced to the target with the given id.
+func (node *ChainNode) SetSynced(targetId string) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.synced[targetId] = true
+}
+
+// Mark the dump as not synced to the target with the given id, e.g. if the
+// target failed to verify it.
+func (node *ChainNode) SetUnsynced(targetId string) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	delete(node.synced, targetId)
+}
+
+// Return whether or not the dump has been synced to the target with the given
+// id.
+func (node *ChainNode) IsSynced(targetId string) bool {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return node.synced[targetId]
 }
 
-func (node ChainNode) IsSynced() bool {
-	return node.synced
+// Return the ids of all targets the dump has been synced to, in sorted order.
+func (node *ChainNode) SyncedTargets() []string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	ids := make([]string, 0, len(node.synced))
+	for id := range node.synced {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
 }
 
 func (node *ChainNode) GetPrev() *ChainNode {
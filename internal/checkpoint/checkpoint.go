@@ -0,0 +1,142 @@
+// Package checkpoint manages named checkpoints, i.e. full dumps of a container
+// taken on request and kept until they are removed.
+//
+// Every checkpoint is stored in its own checkpoint dump directory, along with
+// a metadata file holding its name. The dump has no parent, so a checkpoint can
+// be restored from on any host it has been copied to.
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+)
+
+// The name of the metadata file in the checkpoint's dump directory.
+const FILE_NAME = "checkpoint.json"
+
+type Checkpoint struct {
+	Name string
+	// The name of the dump directory of the checkpoint.
+	Dump        string
+	ContainerId string
+	Created     time.Time
+}
+
+// Return an error if the name may not be used as the name of a checkpoint.
+func ValidName(name string) error {
+	if name == "" {
+		return errors.New("Checkpoint name is empty")
+	}
+	if strings.ContainsAny(name, "/ \t\n") {
+		return errors.Errorf("Checkpoint name %q contains invalid characters", name)
+	}
+	return nil
+}
+
+// Write the metadata of the checkpoint into its dump directory in dir, which
+// must already hold the dump, and update the manifest of the dump directory to
+// include it.
+func Write(dir dump.Dir, cp Checkpoint) error {
+	d := dir.FromString(cp.Dump)
+	content, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode checkpoint")
+	}
+	err = ioutil.WriteFile(path.Join(d.Path(), FILE_NAME), content, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write checkpoint")
+	}
+	return manifest.Write(d.Path())
+}
+
+// Read the metadata of the checkpoint in the dump directory.
+func Read(d *dump.Dump) (*Checkpoint, error) {
+	content, err := ioutil.ReadFile(path.Join(d.Path(), FILE_NAME))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read checkpoint %s", d.Base())
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(content, &cp); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode checkpoint %s", d.Base())
+	}
+	return &cp, nil
+}
+
+// Return all checkpoints in the directory, ordered from the earliest to the
+// latest. Checkpoint dumps without metadata, e.g. unfinished ones, are skipped.
+func List(dir dump.Dir) ([]Checkpoint, error) {
+	dumps, err := dir.Checkpoints()
+	if err != nil {
+		return nil, err
+	}
+	checkpoints := []Checkpoint{}
+	for _, d := range dumps {
+		cp, err := Read(d)
+		if err != nil {
+			log.Warn().
+				Str("Error", err.Error()).
+				Str("Dump", d.Base()).
+				Msg("Skipping checkpoint dump")
+			continue
+		}
+		checkpoints = append(checkpoints, *cp)
+	}
+	return checkpoints, nil
+}
+
+// Return the checkpoint in the directory with the given name, or nil if there
+// is none.
+func Find(dir dump.Dir, name string) (*Checkpoint, error) {
+	checkpoints, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, cp := range checkpoints {
+		if cp.Name == name {
+			return &cp, nil
+		}
+	}
+	return nil, nil
+}
+
+// Return the checkpoint in the directory with the given name, after verifying
+// its dump against its manifest.
+func Get(dir dump.Dir, name string) (*Checkpoint, error) {
+	cp, err := Find(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if cp == nil {
+		return nil, errors.Errorf("There is no checkpoint named %s", name)
+	}
+	if err := manifest.Verify(dir.FromString(cp.Dump).Path()); err != nil {
+		return nil, errors.Wrapf(err, "Checkpoint %s is corrupt", name)
+	}
+	return cp, nil
+}
+
+// Remove the checkpoint in the directory with the given name, and its dump.
+func Remove(dir dump.Dir, name string) error {
+	cp, err := Find(dir, name)
+	if err != nil {
+		return err
+	}
+	if cp == nil {
+		return errors.Errorf("There is no checkpoint named %s", name)
+	}
+	if err := os.RemoveAll(dir.FromString(cp.Dump).Path()); err != nil {
+		return errors.Wrapf(err, "Failed to remove checkpoint %s", name)
+	}
+	log.Info().Str("Name", name).Str("Dump", cp.Dump).Msg("Checkpoint removed")
+	return nil
+}
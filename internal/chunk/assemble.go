@@ -0,0 +1,210 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+)
+
+// The location of a chunk in a file.
+type location struct {
+	file   string
+	offset int64
+	size   int64
+}
+
+// index locates the chunks, and whole files, of the dumps of a directory.
+type index struct {
+	chunks map[string]location
+	// The files of the dumps by their checksum.
+	files map[string]string
+}
+
+// Index the dumps of the directory that have recipes, except the excluded
+// dump.
+func newIndex(dir dump.Dir, exclude string) (*index, error) {
+	idx := &index{chunks: map[string]location{}, files: map[string]string{}}
+	entries, err := ioutil.ReadDir(dir.Path())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read dump directory")
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !dump.IsDumpName(entry.Name()) ||
+			entry.Name() == exclude {
+			continue
+		}
+		dumpPath := path.Join(dir.Path(), entry.Name())
+		r, err := ReadRecipe(dumpPath)
+		if err != nil || len(r.Packed) > 0 {
+			// Not deduplicated, or not yet assembled
+			continue
+		}
+		idx.add(dumpPath, r)
+	}
+	return idx, nil
+}
+
+func (idx *index) add(dumpPath string, r *Recipe) {
+	for _, f := range r.Files {
+		file := path.Join(dumpPath, f.Name)
+		offset := int64(0)
+		for _, c := range f.Chunks {
+			idx.chunks[c.Hash] = location{file: file, offset: offset, size: c.Size}
+			offset += c.Size
+		}
+	}
+	for _, entry := range r.Manifest.Files {
+		if entry.SHA256 != "" {
+			idx.files[entry.SHA256] = path.Join(dumpPath, entry.Name)
+		}
+	}
+}
+
+// Return the hashes of the chunks that are not in the dumps of the directory.
+func Missing(dir dump.Dir, hashes []string) ([]string, error) {
+	idx, err := newIndex(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, h := range hashes {
+		if _, ok := idx.chunks[h]; !ok {
+			missing = append(missing, h)
+		}
+	}
+	return missing, nil
+}
+
+// Assemble the files of the dump from its pack and the chunks of the other
+// dumps of the directory, and verify the dump against its manifest.
+//
+// Files that are identical to files of other dumps are hard linked to them.
+// The pack is removed once the dump has been assembled, while the recipe is
+// kept as the index of the dump's chunks.
+func Assemble(dir dump.Dir, name string) error {
+	if !dump.IsDumpName(name) {
+		return errors.Errorf("Invalid dump name %s", name)
+	}
+	dumpPath := dir.FromString(name).Path()
+	r, err := ReadRecipe(dumpPath)
+	if err != nil {
+		return err
+	}
+	idx, err := newIndex(dir, name)
+	if err != nil {
+		return err
+	}
+
+	// Index the pack
+	packFile := path.Join(dumpPath, PACK_FILE)
+	offset := int64(0)
+	for _, c := range r.Packed {
+		idx.chunks[c.Hash] = location{file: packFile, offset: offset, size: c.Size}
+		offset += c.Size
+	}
+
+	sums := map[string]string{}
+	for _, entry := range r.Manifest.Files {
+		sums[entry.Name] = entry.SHA256
+	}
+	for _, f := range r.Files {
+		dest := path.Join(dumpPath, f.Name)
+		if existing, ok := idx.files[sums[f.Name]]; ok && linkFile(existing, dest) {
+			continue
+		}
+		if err := assembleFile(idx, f, dest); err != nil {
+			return errors.Wrapf(err, "Failed to assemble %s", f.Name)
+		}
+	}
+
+	if err := manifest.Save(dumpPath, &r.Manifest); err != nil {
+		return err
+	}
+	if err := manifest.Verify(dumpPath); err != nil {
+		return err
+	}
+	r.Packed = nil
+	if err := writeRecipe(dumpPath, r); err != nil {
+		return err
+	}
+	os.Remove(packFile)
+	log.Debug().
+		Str("Dump", name).
+		Int("Files", len(r.Files)).
+		Msg("Dump assembled from chunks")
+	return nil
+}
+
+// Hard link the file to dest, replacing dest. Returns whether or not the file
+// was linked.
+func linkFile(file, dest string) bool {
+	tmp := dest + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(file, tmp); err != nil {
+		log.Trace().Str("Error", err.Error()).Str("File", file).Msg("Failed to link file")
+		return false
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return false
+	}
+	log.Trace().Str("File", file).Str("Dest", dest).Msg("Linked identical file")
+	return true
+}
+
+// Write the chunks of the file to dest, replacing dest. Every chunk is verified
+// against its hash, as the files it is read from may have changed since they
+// were indexed.
+func assembleFile(idx *index, f File, dest string) error {
+	tmp := dest + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	files := map[string]*os.File{}
+	defer func() {
+		for _, in := range files {
+			in.Close()
+		}
+	}()
+	buf := make([]byte, _MAX_SIZE)
+	for _, c := range f.Chunks {
+		if c.Size < 0 || c.Size > _MAX_SIZE {
+			return errors.Errorf("Invalid size of chunk %s", c.Hash)
+		}
+		loc, ok := idx.chunks[c.Hash]
+		if !ok || loc.size != c.Size {
+			return errors.Errorf("Missing chunk %s", c.Hash)
+		}
+		in, ok := files[loc.file]
+		if !ok {
+			if in, err = os.Open(loc.file); err != nil {
+				return err
+			}
+			files[loc.file] = in
+		}
+		data := buf[:c.Size]
+		if n, err := in.ReadAt(data, loc.offset); n != len(data) {
+			return errors.Wrapf(err, "Failed to read chunk %s", c.Hash)
+		}
+		if hash(data) != c.Hash {
+			return errors.Errorf("Chunk %s in %s is corrupt", c.Hash, loc.file)
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,141 @@
+package chunk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+)
+
+// The name of the deduplicated file of the dumps.
+const _PAGES = "pages-1.img"
+
+// Write the files to the dump directory, along with its manifest.
+func writeDump(t *testing.T, dumpPath string, files map[string][]byte) {
+	if err := os.MkdirAll(dumpPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dumpPath, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := manifest.Write(dumpPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Stage a dump, whose pages are the pages of the dump d1 of the directory with
+// an edit in the middle, as d2 of the directory, as if it had been
+// transferred. Returns the pages of the staged dump.
+func stageDump(t *testing.T, dir dump.Dir, pages []byte) []byte {
+	edited := append([]byte{}, pages...)
+	copy(edited[len(edited)/2:], randomData(11, 1000))
+
+	src := path.Join(t.TempDir(), "d2")
+	writeDump(t, src, map[string][]byte{_PAGES: edited, "core.img": []byte("core")})
+	r, err := localRecipe(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := []string{}
+	for _, f := range r.Files {
+		for _, c := range f.Chunks {
+			hashes = append(hashes, c.Hash)
+		}
+	}
+	missing, err := Missing(dir, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) == 0 || len(missing) == len(hashes) {
+		t.Fatalf("%d of %d chunks missing, want some", len(missing), len(hashes))
+	}
+	if err := stage(src, dir.FromString("d2").Path(), r, missing); err != nil {
+		t.Fatal(err)
+	}
+	return edited
+}
+
+// Flip the first byte of the file.
+func corrupt(t *testing.T, file string) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0] ^= 0xff
+	if err := ioutil.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		name string
+		// Break the dumps before d2 is assembled.
+		breakDumps func(t *testing.T, dir dump.Dir)
+		// A substring of the expected error, empty if the dump should be
+		// assembled.
+		err string
+	}{
+		{"assembled", func(t *testing.T, dir dump.Dir) {}, ""},
+		{"missing chunk", func(t *testing.T, dir dump.Dir) {
+			os.RemoveAll(dir.FromString("d1").Path())
+		}, "Missing chunk"},
+		{"corrupt chunk", func(t *testing.T, dir dump.Dir) {
+			corrupt(t, path.Join(dir.FromString("d1").Path(), _PAGES))
+		}, "corrupt"},
+		{"corrupt pack", func(t *testing.T, dir dump.Dir) {
+			corrupt(t, path.Join(dir.FromString("d2").Path(), PACK_FILE))
+		}, "corrupt"},
+		{"missing pack", func(t *testing.T, dir dump.Dir) {
+			os.Remove(path.Join(dir.FromString("d2").Path(), PACK_FILE))
+		}, "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := dump.Dir(t.TempDir())
+			pages := randomData(10, 2<<20)
+			base := dir.FromString("d1").Path()
+			writeDump(t, base, map[string][]byte{_PAGES: pages})
+			// Index the chunks of the existing dump, as once it was transferred.
+			if _, err := localRecipe(base); err != nil {
+				t.Fatal(err)
+			}
+			want := stageDump(t, dir, pages)
+			tt.breakDumps(t, dir)
+
+			err := Assemble(dir, "d2")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Assemble() = %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Assemble() = %s", err)
+			}
+			got, err := ioutil.ReadFile(path.Join(dir.FromString("d2").Path(), _PAGES))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("assembled pages differ from the transferred pages")
+			}
+			if _, err := os.Stat(path.Join(dir.FromString("d2").Path(), PACK_FILE)); !os.IsNotExist(err) {
+				t.Fatalf("pack was not removed")
+			}
+		})
+	}
+}
+
+func TestAssembleInvalidName(t *testing.T) {
+	if err := Assemble(dump.Dir(t.TempDir()), "../d1"); err == nil {
+		t.Fatal("Assemble() accepted an invalid dump name")
+	}
+}
@@ -0,0 +1,165 @@
+// Package chunk deduplicates the image files of dumps transferred between
+// nodes.
+//
+// Large files are split into chunks at content-defined boundaries, so that
+// data shifted within a file still produces the same chunks. Instead of the
+// files, the sender transfers a recipe of their chunks and a pack of the
+// chunks the target lacks. The target then assembles the files from the pack
+// and the chunks of the dumps it already has, before the dump is committed.
+// The recipe is kept in the dump directory, as the index of its chunks.
+package chunk
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+)
+
+// The names of the recipe and the pack in the dump directory.
+const (
+	RECIPE_FILE = "chunks.json"
+	PACK_FILE   = "chunks.pack"
+)
+
+// Chunk sizes. Boundaries are placed where the top bits of the rolling hash are
+// zero, giving an average chunk size of about 64 KiB above the minimum.
+const (
+	_MIN_SIZE = 16 << 10
+	_MAX_SIZE = 256 << 10
+	_MASK     = uint64(0xffff) << 48
+	// Smaller files are transferred whole.
+	_MIN_FILE_SIZE = _MAX_SIZE
+)
+
+// The random values of the rolling hash, which must be the same on all nodes.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+}
+
+type Chunk struct {
+	// The hex encoded SHA-256 checksum of the chunk.
+	Hash string
+	Size int64
+}
+
+// The chunks of a file, in order.
+type File struct {
+	Name   string
+	Chunks []Chunk
+}
+
+type Recipe struct {
+	// The manifest of the dump, which the assembled dump is verified against.
+	Manifest manifest.Manifest
+	// The files of the dump that are assembled from chunks.
+	Files []File
+	// The chunks in the pack, in order. Empty once the dump has been
+	// assembled.
+	Packed []Chunk `json:",omitempty"`
+}
+
+// Split the reader into chunks, and call fn with each chunk. The data passed to
+// fn is only valid until fn returns.
+func split(r io.Reader, fn func(data []byte) error) error {
+	buf := make([]byte, _MAX_SIZE)
+	n := 0
+	eof := false
+	for {
+		if !eof {
+			m, err := io.ReadFull(r, buf[n:])
+			n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		cut := cutPoint(buf[:n])
+		if err := fn(buf[:cut]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[cut:n])
+	}
+}
+
+// Return the length of the first chunk of the data.
+func cutPoint(data []byte) int {
+	if len(data) <= _MIN_SIZE {
+		return len(data)
+	}
+	var h uint64
+	for i := _MIN_SIZE; i < len(data); i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&_MASK == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Split the file into chunks.
+func splitFile(file string) ([]Chunk, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunks := []Chunk{}
+	err = split(f, func(data []byte) error {
+		chunks = append(chunks, Chunk{Hash: hash(data), Size: int64(len(data))})
+		return nil
+	})
+	return chunks, err
+}
+
+// Read the recipe of the dump directory.
+func ReadRecipe(dumpPath string) (*Recipe, error) {
+	content, err := ioutil.ReadFile(path.Join(dumpPath, RECIPE_FILE))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read recipe")
+	}
+	var r Recipe
+	if err := json.Unmarshal(content, &r); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode recipe")
+	}
+	return &r, nil
+}
+
+// Write the recipe to the dump directory, replacing any previous recipe
+// atomically.
+func writeRecipe(dumpPath string, r *Recipe) error {
+	content, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode recipe")
+	}
+	tmp := path.Join(dumpPath, RECIPE_FILE+".tmp")
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return errors.Wrap(err, "Failed to write recipe")
+	}
+	if err := os.Rename(tmp, path.Join(dumpPath, RECIPE_FILE)); err != nil {
+		return errors.Wrap(err, "Failed to write recipe")
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package chunk
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Return n random bytes, the same for the same seed.
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Split the data into chunks, returning the chunks.
+func splitData(t *testing.T, data []byte) [][]byte {
+	chunks := [][]byte{}
+	err := split(bytes.NewReader(data), func(c []byte) error {
+		chunks = append(chunks, append([]byte{}, c...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("split failed: %s", err)
+	}
+	return chunks
+}
+
+func TestCutPoint(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		// The expected cut point, or -1 if any cut point within the chunk
+		// sizes is expected.
+		want int
+	}{
+		{"empty", []byte{}, 0},
+		{"single byte", []byte{1}, 1},
+		{"minimum size", randomData(1, _MIN_SIZE), _MIN_SIZE},
+		{"above minimum size", randomData(2, _MIN_SIZE+1), -1},
+		{"maximum size", randomData(3, _MAX_SIZE), -1},
+		{"zeros", make([]byte, _MAX_SIZE), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cut := cutPoint(tt.data)
+			if tt.want >= 0 && cut != tt.want {
+				t.Fatalf("cutPoint() = %d, want %d", cut, tt.want)
+			}
+			if len(tt.data) > _MIN_SIZE && (cut <= _MIN_SIZE || cut > len(tt.data)) {
+				t.Fatalf("cutPoint() = %d, want in (%d, %d]", cut, _MIN_SIZE, len(tt.data))
+			}
+			if again := cutPoint(tt.data); again != cut {
+				t.Fatalf("cutPoint() = %d, then %d", cut, again)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"smaller than minimum", _MIN_SIZE - 1},
+		{"one maximum chunk", _MAX_SIZE},
+		{"many chunks", 4 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomData(4, tt.size)
+			chunks := splitData(t, data)
+			if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+				t.Fatalf("chunks do not add up to the data")
+			}
+			for i, c := range chunks {
+				if len(c) > _MAX_SIZE {
+					t.Fatalf("chunk %d is %d bytes, above the maximum", i, len(c))
+				}
+				if i < len(chunks)-1 && len(c) <= _MIN_SIZE {
+					t.Fatalf("chunk %d is %d bytes, below the minimum", i, len(c))
+				}
+			}
+		})
+	}
+}
+
+// Edits of the data must only change the chunks around the edit, as the
+// boundaries depend on the content rather than the offset.
+func TestSplitStability(t *testing.T) {
+	original := randomData(5, 4<<20)
+	middle := len(original) / 2
+	// An edit changes the chunk it is in, and possibly its neighbour if a
+	// boundary moved.
+	tests := []struct {
+		name string
+		edit func(data []byte) []byte
+		// The maximum number of chunks that may change.
+		changed int
+	}{
+		{"unchanged", func(data []byte) []byte {
+			return data
+		}, 0},
+		{"insert at start", func(data []byte) []byte {
+			return append(randomData(6, 100), data...)
+		}, 2},
+		{"delete at start", func(data []byte) []byte {
+			return data[100:]
+		}, 2},
+		{"overwrite in middle", func(data []byte) []byte {
+			edited := append([]byte{}, data...)
+			copy(edited[middle:], randomData(7, 1000))
+			return edited
+		}, 2},
+		{"insert in middle", func(data []byte) []byte {
+			edited := append([]byte{}, data[:middle]...)
+			edited = append(edited, randomData(8, 1000)...)
+			return append(edited, data[middle:]...)
+		}, 2},
+		{"append", func(data []byte) []byte {
+			return append(append([]byte{}, data...), randomData(9, 1000)...)
+		}, 2},
+	}
+
+	hashes := map[string]bool{}
+	before := splitData(t, original)
+	for _, c := range before {
+		hashes[hash(c)] = true
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after := splitData(t, tt.edit(append([]byte{}, original...)))
+			changed := 0
+			for _, c := range after {
+				if !hashes[hash(c)] {
+					changed++
+				}
+			}
+			if changed > tt.changed {
+				t.Fatalf("%d of %d chunks changed", changed, len(after))
+			}
+		})
+	}
+}
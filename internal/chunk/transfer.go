@@ -0,0 +1,285 @@
+package chunk
+
+import (
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	chain_node "github.com/Xarepo/msc-container-migration/internal/chain/node"
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+	"github.com/Xarepo/msc-container-migration/internal/transport"
+)
+
+type MissingArgs struct {
+	Hashes []string
+}
+
+type AssembleArgs struct {
+	DumpName string
+}
+
+// Transfer the dump of the node to the target with the transport,
+// deduplicated if enabled. Returns a *transport.TransferError if the dump
+// could not be transferred.
+//
+// Falls back to transferring the dump as is if the dump has no files large
+// enough to deduplicate, or if deduplication fails. Transfers that fail on the
+// connection to the target are not retried as is, but by the next sync, which
+// resumes them.
+func TransferDump(
+	t transport.Transport,
+	node *chain_node.ChainNode,
+	target *remote_target.RemoteTarget,
+) error {
+	if err := transferDump(t, node, target); err != nil {
+		return &transport.TransferError{
+			Dump:   node.Dump().Base(),
+			Target: target.Id(),
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+func transferDump(
+	t transport.Transport,
+	node *chain_node.ChainNode,
+	target *remote_target.RemoteTarget,
+) error {
+	// Dumps copied on the local filesystem gain nothing from deduplication
+	if !env.Getenv().DEDUPLICATION || target.Transport == transport.Local {
+		return t.TransferDump(node, target)
+	}
+	err := transferDeduplicated(t, node, target)
+	if err == errNothingToDeduplicate {
+		return t.TransferDump(node, target)
+	}
+	var connErr *connectionError
+	if errors.As(err, &connErr) {
+		return err
+	}
+	if err != nil {
+		log.Warn().
+			Str("Error", err.Error()).
+			Str("Dump", node.Dump().Base()).
+			Str("Target", target.Id()).
+			Msg("Failed to transfer deduplicated dump, transferring it whole")
+		return t.TransferDump(node, target)
+	}
+	return nil
+}
+
+var errNothingToDeduplicate = errors.New("Nothing to deduplicate")
+
+// connectionError is an error of a deduplicated transfer caused by the
+// connection to the target, after which transferring the dump as is would
+// fail as well.
+type connectionError struct {
+	err error
+}
+
+func (e *connectionError) Error() string { return e.err.Error() }
+func (e *connectionError) Cause() error  { return e.err }
+func (e *connectionError) Unwrap() error { return e.err }
+
+// Wrap the error of calling an RPC of the target, marking it as a
+// connectionError unless the target itself returned it.
+func callError(err error, message string) error {
+	err = errors.Wrap(err, message)
+	if _, ok := errors.Cause(err).(rpc.ServerError); ok {
+		return err
+	}
+	return &connectionError{err: err}
+}
+
+func transferDeduplicated(
+	t transport.Transport,
+	node *chain_node.ChainNode,
+	target *remote_target.RemoteTarget,
+) error {
+	d := node.Dump()
+	recipe, err := localRecipe(d.Path())
+	if err != nil {
+		return err
+	}
+	if len(recipe.Files) == 0 {
+		return errNothingToDeduplicate
+	}
+
+	hashes := []string{}
+	sizes := map[string]int64{}
+	for _, f := range recipe.Files {
+		for _, c := range f.Chunks {
+			if _, ok := sizes[c.Hash]; !ok {
+				hashes = append(hashes, c.Hash)
+			}
+			sizes[c.Hash] = c.Size
+		}
+	}
+	client, err := target.Dial()
+	if err != nil {
+		return &connectionError{err: errors.Wrap(err, "Failed to dial target")}
+	}
+	defer client.Close()
+	var missing []string
+	args := MissingArgs{Hashes: hashes}
+	if err := client.Call("RPC.MissingChunks", args, &missing); err != nil {
+		return callError(err, "Failed to query missing chunks")
+	}
+
+	// Stage the dump, with the deduplicated files replaced by the recipe and the
+	// pack, in a temporary directory next to the dump.
+	stagingRoot, err := ioutil.TempDir(path.Dir(d.Path()), ".staging-")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create staging directory")
+	}
+	defer os.RemoveAll(stagingRoot)
+	staged := dump.Dir(stagingRoot).FromString(d.Base())
+	if err := stage(d.Path(), staged.Path(), recipe, missing); err != nil {
+		return errors.Wrap(err, "Failed to stage dump")
+	}
+
+	stagedNode := chain_node.New(staged, node.GetPrev())
+	if err := t.TransferDump(stagedNode, target); err != nil {
+		return &connectionError{err: err}
+	}
+	var reply struct{}
+	assembleArgs := AssembleArgs{DumpName: d.Base()}
+	if err := client.Call("RPC.AssembleDump", assembleArgs, &reply); err != nil {
+		return callError(err, "Failed to assemble dump on target")
+	}
+
+	total, sent := int64(0), int64(0)
+	for _, size := range sizes {
+		total += size
+	}
+	for _, h := range missing {
+		sent += sizes[h]
+	}
+	log.Info().
+		Str("Dump Name", d.Base()).
+		Str("Target", target.Id()).
+		Int("Chunks", len(hashes)).
+		Int("SentChunks", len(missing)).
+		Int64("Bytes", total).
+		Int64("SentBytes", sent).
+		Msg("Dump deduplicated")
+	return nil
+}
+
+// Return the recipe of a local dump, splitting its large files into chunks
+// unless the recipe in the dump directory is up to date. The recipe is saved
+// in the dump directory, so that its chunks are indexed.
+func localRecipe(dumpPath string) (*Recipe, error) {
+	m, err := manifest.Read(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	if r, err := ReadRecipe(dumpPath); err == nil && len(r.Packed) == 0 &&
+		reflect.DeepEqual(r.Manifest, *m) {
+		return r, nil
+	}
+
+	r := Recipe{Manifest: *m, Files: []File{}}
+	for _, entry := range m.Files {
+		if entry.Link != "" || entry.Size < _MIN_FILE_SIZE {
+			continue
+		}
+		chunks, err := splitFile(path.Join(dumpPath, entry.Name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to split %s", entry.Name)
+		}
+		r.Files = append(r.Files, File{Name: entry.Name, Chunks: chunks})
+	}
+	if len(r.Files) > 0 {
+		if err := writeRecipe(dumpPath, &r); err != nil {
+			return nil, err
+		}
+	}
+	return &r, nil
+}
+
+// Stage the dump into dest, linking the files that are not deduplicated, and
+// writing the recipe, the pack of the missing chunks and a manifest of the
+// staged files.
+func stage(src, dest string, r *Recipe, missing []string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	deduplicated := map[string]bool{}
+	for _, f := range r.Files {
+		deduplicated[f.Name] = true
+	}
+	for _, entry := range r.Manifest.Files {
+		if deduplicated[entry.Name] {
+			continue
+		}
+		srcFile := path.Join(src, entry.Name)
+		destFile := path.Join(dest, entry.Name)
+		if entry.Link != "" {
+			err := os.Symlink(entry.Link, destFile)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Link(srcFile, destFile); err != nil {
+			return err
+		}
+	}
+
+	staged := *r
+	staged.Packed = []Chunk{}
+	if err := writePack(src, dest, r, missing, &staged.Packed); err != nil {
+		return err
+	}
+	if err := writeRecipe(dest, &staged); err != nil {
+		return err
+	}
+	return manifest.Write(dest)
+}
+
+// Write the missing chunks of the deduplicated files to the pack, in the order
+// they first occur, and append them to packed.
+func writePack(src, dest string, r *Recipe, missing []string, packed *[]Chunk) error {
+	wanted := map[string]bool{}
+	for _, h := range missing {
+		wanted[h] = true
+	}
+	pack, err := os.Create(path.Join(dest, PACK_FILE))
+	if err != nil {
+		return err
+	}
+	defer pack.Close()
+
+	for _, f := range r.Files {
+		in, err := os.Open(path.Join(src, f.Name))
+		if err != nil {
+			return err
+		}
+		offset := int64(0)
+		for _, c := range f.Chunks {
+			if wanted[c.Hash] {
+				delete(wanted, c.Hash)
+				section := io.NewSectionReader(in, offset, c.Size)
+				if _, err := io.Copy(pack, section); err != nil {
+					in.Close()
+					return err
+				}
+				*packed = append(*packed, c)
+			}
+			offset += c.Size
+		}
+		in.Close()
+	}
+	return pack.Close()
+}
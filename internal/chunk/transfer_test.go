@@ -0,0 +1,31 @@
+package chunk
+
+import (
+	"net/rpc"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// Only errors of the connection to the target keep dumps from being
+// transferred as is.
+func TestCallError(t *testing.T) {
+	tests := []struct {
+		err        error
+		connection bool
+	}{
+		{rpc.ServerError("Failed to assemble dump"), false},
+		{rpc.ErrShutdown, true},
+		{errors.New("read: connection reset by peer"), true},
+	}
+	for _, tt := range tests {
+		var connErr *connectionError
+		err := callError(tt.err, "Failed to call")
+		if errors.As(err, &connErr) != tt.connection {
+			t.Errorf("callError(%v) = %v, want connection error %t", tt.err, err, tt.connection)
+		}
+		if errors.Cause(err) != tt.err {
+			t.Errorf("Cause(%v) = %v", err, errors.Cause(err))
+		}
+	}
+}
@@ -7,9 +7,12 @@ import (
 )
 
 var cli struct {
-	Run     cli_commands.Run     `kong:"cmd,help:'Run a container'"`
-	Join    cli_commands.Join    `kong:"cmd,help:'Join a cluster'"`
-	Migrate cli_commands.Migrate `kong:"cmd,help:'Migrate a container'"`
+	Run        cli_commands.Run        `kong:"cmd,help:'Run a container'"`
+	Join       cli_commands.Join       `kong:"cmd,help:'Join a cluster'"`
+	Migrate    cli_commands.Migrate    `kong:"cmd,help:'Migrate a container'"`
+	Status     cli_commands.Status     `kong:"cmd,help:'Show the status of the runner'"`
+	Checkpoint cli_commands.Checkpoint `kong:"cmd,help:'Manage checkpoints'"`
+	Daemon     cli_commands.Daemon     `kong:"cmd,help:'Host many containers in one process'"`
 }
 
 type CliCommand interface {
@@ -25,6 +28,26 @@ func Parse() CliCommand {
 		return cli.Join
 	case "migrate <container-id>":
 		return cli.Migrate
+	case "status":
+		return cli.Status
+	case "checkpoint create":
+		return cli.Checkpoint.Create
+	case "checkpoint ls":
+		return cli.Checkpoint.Ls
+	case "checkpoint restore <name>":
+		return cli.Checkpoint.Restore
+	case "checkpoint rm <name>":
+		return cli.Checkpoint.Rm
+	case "daemon start":
+		return cli.Daemon.Start
+	case "daemon run <container-id>":
+		return cli.Daemon.Run
+	case "daemon join <remote>":
+		return cli.Daemon.Join
+	case "daemon stop <container-id>":
+		return cli.Daemon.Stop
+	case "daemon ls":
+		return cli.Daemon.Ls
 	default:
 		panic(ctx.Command())
 	}
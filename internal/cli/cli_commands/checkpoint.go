@@ -0,0 +1,156 @@
+package cli_commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/checkpoint"
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/ipc"
+	"github.com/Xarepo/msc-container-migration/internal/runner"
+	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+	"github.com/Xarepo/msc-container-migration/internal/usock_listener"
+)
+
+type Checkpoint struct {
+	Create  CheckpointCreate  `kong:"cmd,help:'Checkpoint the running container'"`
+	Ls      CheckpointLs      `kong:"cmd,help:'List the checkpoints on this host'"`
+	Restore CheckpointRestore `kong:"cmd,help:'Run a container restored from a checkpoint'"`
+	Rm      CheckpointRm      `kong:"cmd,help:'Remove a checkpoint from this host'"`
+}
+
+type CheckpointCreate struct {
+	Name        string `kong:"help='The name of the checkpoint. Defaults to the name of its dump'"`
+	Replicate   bool   `kong:"help='Copy the checkpoint to all targets, so that it can be restored on them'"`
+	ContainerId string `kong:"help='The id of the container to checkpoint. May be omitted if there is only one runner on the host'"`
+	Socket      string `kong:"help='The path of the IPC socket of the runner to checkpoint',type='path'"`
+}
+
+func (cmd CheckpointCreate) Execute() error {
+	log.Trace().
+		Str("Name", cmd.Name).
+		Bool("Replicate", cmd.Replicate).
+		Msg("Executing checkpoint create command")
+	sockAddr, err := usock_listener.FindControlAddr(cmd.ContainerId, cmd.Socket)
+	if err != nil {
+		return err
+	}
+	var result ipc.CheckpointResult
+	err = ipc.Send(sockAddr, &ipc.Checkpoint{
+		Name:      cmd.Name,
+		Replicate: cmd.Replicate,
+	}, &result)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created checkpoint %s (%s)\n", result.Name, result.Dump)
+	for _, target := range result.ReplicatedTo {
+		fmt.Printf("Replicated to %s\n", target)
+	}
+	return nil
+}
+
+type CheckpointLs struct {
+	Json        bool   `kong:"help='Print the checkpoints as JSON'"`
+	ContainerId string `kong:"help='The id of the container to list the checkpoints of'"`
+	DumpPath    string `kong:"help='The directory of the checkpoints. Defaults to the directory of the container, DUMP_PATH/containers/<container-id>',type='path'"`
+}
+
+func (cmd CheckpointLs) Execute() error {
+	log.Trace().Bool("Json", cmd.Json).Msg("Executing checkpoint ls command")
+	checkpoints, err := checkpoint.List(checkpointDir(cmd.DumpPath, cmd.ContainerId))
+	if err != nil {
+		return err
+	}
+
+	if cmd.Json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(checkpoints)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tDUMP\tCONTAINER\tCREATED\n")
+	for _, cp := range checkpoints {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\n",
+			cp.Name,
+			cp.Dump,
+			cp.ContainerId,
+			cp.Created.Format(time.RFC3339),
+		)
+	}
+	return w.Flush()
+}
+
+type CheckpointRestore struct {
+	Name        string `kong:"arg,help='The name of the checkpoint to restore'"`
+	ContainerId string `kong:"help='The id to assign to the container. Defaults to the id of the checkpointed container'"`
+	BundlePath  string `kong:"help='The path to the OCI-bundle to restore the container with',type='path',default='.'"`
+	Socket      string `kong:"help='The path of the IPC socket. Defaults to <container-id>.sock in SOCKET_DIR',type='path'"`
+	DumpPath    string `kong:"help='The directory of the checkpoints. Defaults to the directory of the container, DUMP_PATH/containers/<container-id>',type='path'"`
+}
+
+// Execute the checkpoint restore command.
+//
+// The command runs the container restored from the checkpoint, in the same way
+// as the run command runs a new container. The function does not return until
+// the container has exited.
+func (cmd CheckpointRestore) Execute() error {
+	log.Trace().
+		Str("Name", cmd.Name).
+		Str("ContainerId", cmd.ContainerId).
+		Str("BundlePath", cmd.BundlePath).
+		Msg("Executing checkpoint restore command")
+	dir := checkpointDir(cmd.DumpPath, cmd.ContainerId)
+	cp, err := checkpoint.Get(dir, cmd.Name)
+	if err != nil {
+		return err
+	}
+	containerId := cmd.ContainerId
+	if containerId == "" {
+		containerId = cp.ContainerId
+	}
+
+	runner := runner.New(containerId, cmd.BundlePath)
+	runner.SockAddr = cmd.Socket
+	runner.DumpDir = dir
+
+	runner.Start()
+	runner.RestoreCheckpoint(*dir.FromString(cp.Dump))
+
+	log.Trace().Msg("Waiting for container to exit")
+	status := runner.WaitForContainer()
+	log.Info().Int("Status", status).Msg("Container exited")
+
+	log.Info().Msg("Stopping runner...")
+	runner.SetStatus(runner_context.Stopped)
+	runner.Shutdown()
+	return nil
+}
+
+type CheckpointRm struct {
+	Name        string `kong:"arg,help='The name of the checkpoint to remove'"`
+	ContainerId string `kong:"help='The id of the container to remove the checkpoint of'"`
+	DumpPath    string `kong:"help='The directory of the checkpoints. Defaults to the directory of the container, DUMP_PATH/containers/<container-id>',type='path'"`
+}
+
+func (cmd CheckpointRm) Execute() error {
+	log.Trace().Str("Name", cmd.Name).Msg("Executing checkpoint rm command")
+	return checkpoint.Remove(checkpointDir(cmd.DumpPath, cmd.ContainerId), cmd.Name)
+}
+
+// Return the directory of the checkpoints, the directory of the dumps of the
+// container unless another path is given.
+func checkpointDir(dumpPath, containerId string) dump.Dir {
+	if dumpPath == "" {
+		return dump.RunnerDir(containerId)
+	}
+	return dump.Dir(dumpPath)
+}
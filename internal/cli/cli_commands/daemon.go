@@ -0,0 +1,115 @@
+package cli_commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/daemon"
+)
+
+type Daemon struct {
+	Start DaemonStart `kong:"cmd,help:'Start a daemon hosting the runners of many containers'"`
+	Run   DaemonRun   `kong:"cmd,help:'Run a container in the daemon'"`
+	Join  DaemonJoin  `kong:"cmd,help:'Join a cluster as a standby in the daemon'"`
+	Stop  DaemonStop  `kong:"cmd,help:'Stop the runner of a container in the daemon'"`
+	Ls    DaemonLs    `kong:"cmd,help:'List the runners of the daemon'"`
+}
+
+type DaemonStart struct{}
+
+// Execute the daemon start command.
+// The function does not return until the daemon has been signaled to stop and
+// all of its runners have stopped.
+func (cmd DaemonStart) Execute() error {
+	log.Trace().Msg("Executing daemon start command")
+	return daemon.New().Run()
+}
+
+type DaemonRun struct {
+	ContainerId string `kong:"arg,help='The id to assign to the container'"`
+	BundlePath  string `kong:"help='The path to the OCI-bundle to build the container from',type='path',default='.'"`
+}
+
+func (cmd DaemonRun) Execute() error {
+	log.Trace().
+		Str("BundlePath", cmd.BundlePath).
+		Str("ContainerId", cmd.ContainerId).
+		Msg("Executing daemon run command")
+	var result daemon.RunnerInfo
+	err := daemon.Send(daemon.REQ_RUN, daemon.RunArgs{
+		ContainerId: cmd.ContainerId,
+		BundlePath:  cmd.BundlePath,
+	}, &result)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Running %s, endpoint %s\n", result.ContainerId, result.Endpoint)
+	return nil
+}
+
+type DaemonJoin struct {
+	Remote      string `kong:"arg,help='The RPC-endpoint of the runner to join'"`
+	ContainerId string `kong:"help='The id of the container of the cluster. Defaults to the container id of the endpoint'"`
+}
+
+func (cmd DaemonJoin) Execute() error {
+	log.Trace().
+		Str("Remote", cmd.Remote).
+		Str("ContainerId", cmd.ContainerId).
+		Msg("Executing daemon join command")
+	var result daemon.RunnerInfo
+	err := daemon.Send(daemon.REQ_JOIN, daemon.JoinArgs{
+		Remote:      cmd.Remote,
+		ContainerId: cmd.ContainerId,
+	}, &result)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Joined %s as standby of %s\n", result.Endpoint, result.Source)
+	return nil
+}
+
+type DaemonStop struct {
+	ContainerId string `kong:"arg,help='The id of the container to stop'"`
+}
+
+func (cmd DaemonStop) Execute() error {
+	log.Trace().Str("ContainerId", cmd.ContainerId).Msg("Executing daemon stop command")
+	return daemon.Send(
+		daemon.REQ_STOP,
+		daemon.StopArgs{ContainerId: cmd.ContainerId},
+		nil,
+	)
+}
+
+type DaemonLs struct {
+	Json bool `kong:"help='Print the runners as JSON'"`
+}
+
+func (cmd DaemonLs) Execute() error {
+	log.Trace().Bool("Json", cmd.Json).Msg("Executing daemon ls command")
+	var runners []daemon.RunnerInfo
+	if err := daemon.Send(daemon.REQ_LS, struct{}{}, &runners); err != nil {
+		return err
+	}
+
+	if cmd.Json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(runners)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "CONTAINER\tSTATUS\tENDPOINT\tSOURCE\n")
+	for _, r := range runners {
+		source := r.Source
+		if source == "" {
+			source = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.ContainerId, r.Status, r.Endpoint, source)
+	}
+	return w.Flush()
+}
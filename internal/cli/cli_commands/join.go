@@ -9,12 +9,14 @@ import (
 
 type Join struct {
 	Remote string `kong:"arg,help='The RPC-address of the remote host to join'"`
+	Socket string `kong:"help='The path of the IPC socket. Defaults to <container-id>.sock in SOCKET_DIR, once the container id is received from the remote',type='path'"`
 }
 
 func (cmd Join) Execute() error {
 	// Prepare new runner by creating it with empty values
 	r := runner.New("", ".")
 	r.Source = cmd.Remote
+	r.SockAddr = cmd.Socket
 
 	r.Start()
 	r.SetStatus(runner_context.Joining)
@@ -26,6 +28,7 @@ func (cmd Join) Execute() error {
 	log.Info().Msg("Stopping runner...")
 	r.WaitFor()
 	r.SetStatus(runner_context.Stopped)
+	r.Shutdown()
 
 	return nil
 }
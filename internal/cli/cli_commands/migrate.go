@@ -1,21 +1,42 @@
 package cli_commands
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/rs/zerolog/log"
 
 	"github.com/Xarepo/msc-container-migration/internal/ipc"
+	"github.com/Xarepo/msc-container-migration/internal/usock_listener"
 )
 
 type Migrate struct {
-	ContainerId string `kong:"arg,help='The id of the container to migrate'"`
+	ContainerId string        `kong:"arg,help='The id of the container to migrate'"`
+	To          string        `kong:"help='The RPC-address (host:port) of the target to migrate to. Defaults to the first target',placeholder='HOST:PORT'"`
+	Socket      string        `kong:"help='The path of the IPC socket of the runner. Defaults to <container-id>.sock in SOCKET_DIR',type='path'"`
+	MaxDowntime time.Duration `kong:"help='The maximum downtime of the migration, e.g. 200ms. The migration is aborted if the downtime is not estimated to fit within it'"`
 }
 
 func (cmd Migrate) Execute() error {
 	log.Trace().
 		Str("ContainerId", cmd.ContainerId).
+		Str("To", cmd.To).
+		Str("MaxDowntime", cmd.MaxDowntime.String()).
 		Msg("Executing migrate command")
-	ipc := ipc.Migrate{ContainerId: cmd.ContainerId}
-	ipc.Send()
+	sockAddr, err := usock_listener.FindControlAddr(cmd.ContainerId, cmd.Socket)
+	if err != nil {
+		return err
+	}
+	var result ipc.MigrateResult
+	err = ipc.Send(sockAddr, &ipc.Migrate{
+		ContainerId: cmd.ContainerId,
+		To:          cmd.To,
+		MaxDowntime: cmd.MaxDowntime,
+	}, &result)
+	if err != nil {
+		return err
+	}
 
+	fmt.Printf("Migrated %s to %s\n", result.ContainerId, result.Destination)
 	return nil
 }
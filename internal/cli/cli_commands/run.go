@@ -4,6 +4,7 @@ import (
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/rs/zerolog/log"
 
+	"github.com/Xarepo/msc-container-migration/internal/dump"
 	"github.com/Xarepo/msc-container-migration/internal/runner"
 	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
 )
@@ -11,6 +12,7 @@ import (
 type Run struct {
 	ContainerId string `kong:"arg,help='The id to assign to the container'"`
 	BundlePath  string `kong:"help='The path to the OCI-bundle to build the container from',type='path',default='.'"`
+	Socket      string `kong:"help='The path of the IPC socket. Defaults to <container-id>.sock in SOCKET_DIR',type='path'"`
 }
 
 // Execute the run command.
@@ -23,8 +25,12 @@ func (cmd Run) Execute() error {
 		Str("BundlePath", cmd.BundlePath).
 		Str("ContainerId", cmd.ContainerId).
 		Msg("Executing run command")
+	if err := dump.ValidContainerId(cmd.ContainerId); err != nil {
+		return err
+	}
 
 	runner := runner.New(cmd.ContainerId, cmd.BundlePath)
+	runner.SockAddr = cmd.Socket
 
 	runner.Start()
 	runner.StartContainer()
@@ -35,5 +41,6 @@ func (cmd Run) Execute() error {
 
 	log.Info().Msg("Stopping runner...")
 	runner.SetStatus(runner_context.Stopped)
+	runner.Shutdown()
 	return nil
 }
@@ -0,0 +1,99 @@
+package cli_commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/ipc"
+	"github.com/Xarepo/msc-container-migration/internal/usock_listener"
+)
+
+type Status struct {
+	Json        bool   `kong:"help='Print the status as JSON'"`
+	ContainerId string `kong:"help='The id of the container of the runner. May be omitted if there is only one runner on the host'"`
+	Socket      string `kong:"help='The path of the IPC socket of the runner',type='path'"`
+}
+
+// Execute the status command.
+//
+// The status command prints the state of the runner, its dump chains and its
+// targets.
+func (cmd Status) Execute() error {
+	log.Trace().Bool("Json", cmd.Json).Msg("Executing status command")
+	sockAddr, err := usock_listener.FindControlAddr(cmd.ContainerId, cmd.Socket)
+	if err != nil {
+		return err
+	}
+	var result ipc.StatusResult
+	if err := ipc.Send(sockAddr, &ipc.Status{}, &result); err != nil {
+		return err
+	}
+
+	if cmd.Json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	printStatus(result)
+	return nil
+}
+
+func printStatus(result ipc.StatusResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Status:\t%s\n", result.Status)
+	fmt.Fprintf(w, "Container:\t%s\n", result.ContainerId)
+	fmt.Fprintf(w, "Bundle:\t%s\n", result.BundlePath)
+	if result.Source != "" {
+		fmt.Fprintf(
+			w,
+			"Source:\t%s (last ping %s)\n",
+			result.Source,
+			formatPing(result.SourceLastPing),
+		)
+	}
+	w.Flush()
+
+	printChain("Chain", result.Chain)
+	printChain("Previous chain", result.PrevChain)
+
+	fmt.Printf("\nTargets:\n")
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  ID\tTRANSPORT\tLAST PING\n")
+	for _, target := range result.Targets {
+		fmt.Fprintf(
+			w,
+			"  %s\t%s\t%s\n",
+			target.Id,
+			target.Transport,
+			formatPing(target.LastPing),
+		)
+	}
+	w.Flush()
+}
+
+func printChain(title string, dumps []ipc.DumpStatus) {
+	fmt.Printf("\n%s:\n", title)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  DUMP\tSIZE\tSYNCED TO\n")
+	for _, d := range dumps {
+		size := "-"
+		if d.Size >= 0 {
+			size = fmt.Sprintf("%d", d.Size)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", d.Name, size, strings.Join(d.SyncedTargets, ","))
+	}
+	w.Flush()
+}
+
+func formatPing(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", time.Since(t).Round(time.Millisecond))
+}
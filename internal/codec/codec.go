@@ -0,0 +1,212 @@
+// Package codec provides the compression codecs dumps are transferred with.
+//
+// The codec of a target is agreed when it joins the cluster: the target
+// advertises the codecs it accepts, and the source picks the first of its own
+// codecs that the target accepts.
+package codec
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Available codecs
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+type Codec interface {
+	Name() string
+	// The extension of files compressed with the codec, e.g. ".gz". Empty for
+	// the codec not compressing at all.
+	Ext() string
+	// Return a writer compressing everything written to it into w. Closing
+	// the writer flushes it, but does not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// Return a reader decompressing r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Return the codec with the given name. An empty name selects the codec not
+// compressing at all, which targets that have not agreed on a codec use.
+func New(name string) (Codec, error) {
+	switch name {
+	case None, "":
+		return noneCodec{}, nil
+	case Gzip:
+		return gzipCodec{}, nil
+	case Zstd:
+		return zstdCodec{}, nil
+	default:
+		return nil, errors.Errorf("Unknown codec %s", name)
+	}
+}
+
+// Return the codec that files with the name are compressed with, if any.
+func FromFile(name string) Codec {
+	for _, c := range []Codec{gzipCodec{}, zstdCodec{}} {
+		if strings.HasSuffix(name, c.Ext()) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Return the first of the preferred codecs that is also accepted, or None if
+// there is none.
+func Negotiate(preferred, accepted []string) string {
+	for _, p := range preferred {
+		for _, a := range accepted {
+			if p == a {
+				return p
+			}
+		}
+	}
+	return None
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return None }
+func (noneCodec) Ext() string  { return "" }
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return Gzip }
+func (gzipCodec) Ext() string  { return ".gz" }
+
+// Dumps are compressed while being transferred, so speed is preferred over
+// ratio.
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.BestSpeed)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return Zstd }
+func (zstdCodec) Ext() string  { return ".zst" }
+
+// Dumps are compressed while being transferred, so speed is preferred over
+// ratio. A single goroutine is used, so that the same file is always
+// compressed into the same bytes, which resumed transfers rely on.
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(
+		w,
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithEncoderConcurrency(1),
+	)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// Stats of the compression of a transfer.
+type Stats struct {
+	Codec string
+	// The number of bytes before and after compression.
+	Raw, Compressed int64
+	// The time spent compressing, excluding the time spent writing the
+	// compressed bytes.
+	Elapsed time.Duration
+}
+
+// Return a writer compressing into w with the codec, and counting the bytes
+// and time spent into the stats.
+func (stats *Stats) NewWriter(c Codec, w io.Writer) (io.WriteCloser, error) {
+	cw, err := c.NewWriter(&countingWriter{w: w, stats: stats})
+	if err != nil {
+		return nil, err
+	}
+	return &statsWriter{w: cw, stats: stats}, nil
+}
+
+// Log the stats of the transfer of the dump.
+func (stats *Stats) Log(dumpName, target string, duration time.Duration) {
+	log.Info().
+		Str("Dump Name", dumpName).
+		Str("Target", target).
+		Str("Codec", stats.Codec).
+		Int64("Bytes", stats.Raw).
+		Int64("CompressedBytes", stats.Compressed).
+		Int64("BytesSaved", stats.Raw-stats.Compressed).
+		Str("Ratio", stats.ratio()).
+		Str("CompressionTime", stats.Elapsed.String()).
+		Str("Duration", duration.String()).
+		Msg("Dump transferred")
+}
+
+func (stats *Stats) ratio() string {
+	if stats.Compressed == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", float64(stats.Raw)/float64(stats.Compressed))
+}
+
+// countingWriter counts the compressed bytes, and subtracts the time spent
+// writing them from the time spent compressing.
+type countingWriter struct {
+	w     io.Writer
+	stats *Stats
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := cw.w.Write(p)
+	cw.stats.Elapsed -= time.Since(start)
+	cw.stats.Compressed += int64(n)
+	return n, err
+}
+
+// statsWriter counts the bytes written to the codec, and the time spent in it.
+type statsWriter struct {
+	w     io.WriteCloser
+	stats *Stats
+}
+
+func (sw *statsWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := sw.w.Write(p)
+	sw.stats.Elapsed += time.Since(start)
+	sw.stats.Raw += int64(n)
+	return n, err
+}
+
+func (sw *statsWriter) Close() error {
+	start := time.Now()
+	err := sw.w.Close()
+	sw.stats.Elapsed += time.Since(start)
+	return err
+}
@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("pages of a dump "), 1<<14)
+	for _, name := range []string{None, Gzip, Zstd} {
+		t.Run(name, func(t *testing.T) {
+			c, err := New(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compress := func() []byte {
+				var buf bytes.Buffer
+				w, err := c.NewWriter(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				return buf.Bytes()
+			}
+			compressed := compress()
+			// Resumed transfers rely on the same data always being compressed
+			// into the same bytes.
+			if !bytes.Equal(compressed, compress()) {
+				t.Fatal("compression is not deterministic")
+			}
+
+			r, err := c.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			decompressed, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Fatal("decompressed data differs")
+			}
+			if got := FromFile("pages-1.img" + c.Ext()); name != None && got == nil {
+				t.Fatalf("FromFile() found no codec for %s", c.Ext())
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if c, err := New(""); err != nil || c.Name() != None {
+		t.Fatalf("New(\"\") = %v, %v, want %s", c, err, None)
+	}
+	if _, err := New("lz4"); err == nil {
+		t.Fatal("New(\"lz4\") succeeded")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name                string
+		preferred, accepted []string
+		want                string
+	}{
+		{"first preferred", []string{Zstd, Gzip}, []string{Gzip, Zstd}, Zstd},
+		{"only common", []string{Zstd, Gzip}, []string{Gzip, None}, Gzip},
+		{"none in common", []string{Zstd}, []string{Gzip}, None},
+		{"nothing accepted", []string{Zstd, Gzip}, nil, None},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Negotiate(tt.preferred, tt.accepted); got != tt.want {
+				t.Fatalf("Negotiate() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+// Package daemon hosts the runners of many containers in a single process.
+//
+// The runners share the daemon's RPC listener, which routes each RPC to its
+// runner by the name in the HTTP path, and dump receiver. Each runner keeps
+// its dumps in a directory of its own in the dump path, and listens for IPCs
+// on its own sockets, so containers hosted by a daemon are migrated,
+// checkpointed and inspected in the same way as standalone ones.
+//
+// Runners are created and stopped through requests to the daemon's control
+// socket.
+package daemon
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/ipc"
+	. "github.com/Xarepo/msc-container-migration/internal/ipc_listener"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+	"github.com/Xarepo/msc-container-migration/internal/runner"
+	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+	"github.com/Xarepo/msc-container-migration/internal/usock_listener"
+)
+
+// Available requests
+const (
+	REQ_RUN  = "RUN"
+	REQ_JOIN = "JOIN"
+	REQ_STOP = "STOP"
+	REQ_LS   = "LS"
+)
+
+type RunArgs struct {
+	ContainerId, BundlePath string
+}
+
+type JoinArgs struct {
+	// The RPC endpoint of the runner to join, "host:port" for standalone
+	// runners and "host:port/<container-id>" for runners hosted by a daemon.
+	Remote string
+	// The id of the container of the cluster. May be empty if the remote is
+	// hosted by a daemon, in which case the id is taken from the endpoint.
+	ContainerId string
+}
+
+type StopArgs struct {
+	ContainerId string
+}
+
+// RunnerInfo describes a runner hosted by the daemon.
+type RunnerInfo struct {
+	ContainerId string
+	Status      runner_context.RunnerStatus
+	// The RPC endpoint of the runner, which other runners join.
+	Endpoint string
+	// The source the runner replicates from, only set for standbys.
+	Source string `json:",omitempty"`
+}
+
+type Daemon struct {
+	lock    sync.Mutex
+	runners map[string]*runner.Runner
+	// Runners that have not yet been shut down.
+	active   sync.WaitGroup
+	listener IPCListener
+}
+
+func New() *Daemon {
+	return &Daemon{
+		runners:  map[string]*runner.Runner{},
+		listener: &usock_listener.USockStreamListener{},
+	}
+}
+
+// Send a request to the daemon on this host, and decode its result into
+// result.
+func Send(command string, args interface{}, result interface{}) error {
+	return ipc.SendRequest(usock_listener.DaemonAddr(), command, args, result)
+}
+
+// Run the daemon.
+// Blocks until the daemon receives a signal to terminate, upon which all
+// runners are stopped.
+func (d *Daemon) Run() error {
+	l, err := net.Listen(
+		"tcp",
+		net.JoinHostPort(env.Getenv().RPC_IP, strconv.Itoa(env.Getenv().RPC_PORT)),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to listen for RPCs")
+	}
+	go http.Serve(l, d)
+	go func() {
+		// The runners keep running, but their standbys no longer receive dumps
+		if err := runner.ReceiveDumps(); err != nil {
+			log.Error().Str("Error", err.Error()).Msg("Failed to receive dumps")
+		}
+	}()
+
+	sockAddr := usock_listener.DaemonAddr()
+	go func() {
+		if err := d.listener.Listen(sockAddr, d.handle); err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Failed to listen for requests")
+		}
+	}()
+	log.Info().Str("Address", sockAddr).Msg("Daemon started")
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	s := <-c
+	log.Info().Str("Signal", s.String()).Msg("Received signal, stopping runners")
+
+	d.listener.Close()
+	for _, info := range d.list() {
+		if err := d.stop(info.ContainerId); err != nil {
+			log.Error().
+				Str("Error", err.Error()).
+				Str("ContainerId", info.ContainerId).
+				Msg("Failed to stop runner")
+		}
+	}
+	d.active.Wait()
+	log.Info().Msg("Daemon stopped")
+	return nil
+}
+
+// Route an RPC to the runner named in the path of the request.
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, ok := remote_target.RPCNameFromPath(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	d.lock.Lock()
+	r := d.runners[name]
+	d.lock.Unlock()
+	if r == nil {
+		http.Error(w, "No runner for container "+name, http.StatusNotFound)
+		return
+	}
+	r.ServeRPC(w, req)
+}
+
+func (d *Daemon) handle(buf []byte) []byte {
+	return ipc.Serve(buf, d.execute)
+}
+
+func (d *Daemon) execute(command string, args json.RawMessage) (interface{}, error) {
+	switch command {
+	case REQ_RUN:
+		var a RunArgs
+		if err := json.Unmarshal(args, &a); err != nil {
+			return nil, errors.Wrap(err, "Failed to decode arguments")
+		}
+		return d.run(a)
+	case REQ_JOIN:
+		var a JoinArgs
+		if err := json.Unmarshal(args, &a); err != nil {
+			return nil, errors.Wrap(err, "Failed to decode arguments")
+		}
+		return d.join(a)
+	case REQ_STOP:
+		var a StopArgs
+		if err := json.Unmarshal(args, &a); err != nil {
+			return nil, errors.Wrap(err, "Failed to decode arguments")
+		}
+		return nil, d.stop(a.ContainerId)
+	case REQ_LS:
+		return d.list(), nil
+	default:
+		return nil, errors.Errorf("Unknown request %s", command)
+	}
+}
+
+// Run a new container.
+func (d *Daemon) run(args RunArgs) (*RunnerInfo, error) {
+	r, err := d.add(args.ContainerId, args.BundlePath)
+	if err != nil {
+		return nil, err
+	}
+	r.StartHosted()
+	r.StartContainer()
+	go d.watch(r)
+	return info(r), nil
+}
+
+// Join the cluster of a container as a standby.
+func (d *Daemon) join(args JoinArgs) (*RunnerInfo, error) {
+	containerId := args.ContainerId
+	if containerId == "" {
+		_, containerId = remote_target.SplitEndpoint(args.Remote)
+	}
+	if containerId == "" {
+		return nil, errors.New(
+			"The container id must be given when joining a standalone runner",
+		)
+	}
+
+	r, err := d.add(containerId, ".")
+	if err != nil {
+		return nil, err
+	}
+	r.Source = args.Remote
+	r.StartHosted()
+	r.SetStatus(runner_context.Joining)
+	go d.watch(r)
+
+	// Report the result of joining
+	status := r.WaitForStatus(runner_context.StandBy, runner_context.Failed)
+	if status == runner_context.Failed {
+		return nil, errors.Errorf("Failed to join %s", args.Remote)
+	}
+	return info(r), nil
+}
+
+// Create a runner for the container, and add it to the daemon.
+func (d *Daemon) add(containerId, bundlePath string) (*runner.Runner, error) {
+	if err := dump.ValidContainerId(containerId); err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.runners[containerId]; ok {
+		return nil, errors.Errorf("Container %s is already hosted", containerId)
+	}
+
+	r := runner.New(containerId, bundlePath)
+	r.RPCName = containerId
+	r.DumpDir = dump.ContainerDir(containerId)
+	d.runners[containerId] = r
+	d.active.Add(1)
+	log.Info().Str("ContainerId", containerId).Msg("Runner added")
+	return r, nil
+}
+
+// Wait for the runner to stop or fail, and then remove it from the daemon.
+func (d *Daemon) watch(r *runner.Runner) {
+	for {
+		status := r.Status()
+		if status == runner_context.Stopped || status == runner_context.Failed {
+			break
+		}
+		select {
+		case exitStatus := <-r.ContainerStatus:
+			log.Info().
+				Str("ContainerId", r.ContainerId).
+				Int("Status", exitStatus).
+				Msg("Container exited")
+			r.SetStatus(runner_context.Stopped)
+		case <-r.Leaving(status):
+		}
+	}
+
+	r.Shutdown()
+	d.lock.Lock()
+	delete(d.runners, r.ContainerId)
+	d.lock.Unlock()
+	d.active.Done()
+	log.Info().
+		Str("ContainerId", r.ContainerId).
+		Str("Status", string(r.Status())).
+		Msg("Runner removed")
+}
+
+// Stop the runner of the container, killing the container if it is running.
+func (d *Daemon) stop(containerId string) error {
+	d.lock.Lock()
+	r := d.runners[containerId]
+	d.lock.Unlock()
+	if r == nil {
+		return errors.Errorf("Container %s is not hosted", containerId)
+	}
+	// Only runners running the container have a container to kill
+	switch status := r.Status(); status {
+	case runner_context.StandBy:
+		return r.SetStatus(runner_context.Stopped)
+	case runner_context.Running, runner_context.Migrating:
+		return r.Terminate()
+	case runner_context.Stopped, runner_context.Failed:
+		return nil
+	default:
+		return errors.Errorf(
+			"Runner of container %s is %s, and cannot be stopped until it is"+
+				" standing by or running",
+			containerId,
+			status,
+		)
+	}
+}
+
+// Return the runners of the daemon, ordered by container id.
+// The daemon's lock is not held while describing the runners, as it is needed
+// to route the RPCs of every runner.
+func (d *Daemon) list() []RunnerInfo {
+	d.lock.Lock()
+	runners := make([]*runner.Runner, 0, len(d.runners))
+	for _, r := range d.runners {
+		runners = append(runners, r)
+	}
+	d.lock.Unlock()
+	infos := []RunnerInfo{}
+	for _, r := range runners {
+		infos = append(infos, *info(r))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ContainerId < infos[j].ContainerId
+	})
+	return infos
+}
+
+// Describe the runner without waiting for its lock, which the runner holds
+// while e.g. dumping or migrating. The container id of a hosted runner never
+// changes, and the rest is read from the runner's snapshot.
+func info(r *runner.Runner) *RunnerInfo {
+	return &RunnerInfo{
+		ContainerId: r.ContainerId,
+		Status:      r.Status(),
+		Endpoint:    r.ToTarget().Id(),
+		Source:      r.Snapshot().Source,
+	}
+}
@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+)
+
+// Listing the runners must not wait for a runner that holds its lock, e.g.
+// while dumping.
+func TestListWhileLocked(t *testing.T) {
+	d := New()
+	r, err := d.add("counter", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go r.WithLock(func() {
+		close(locked)
+		<-release
+	})
+	<-locked
+
+	listed := make(chan []RunnerInfo, 1)
+	go func() { listed <- d.list() }()
+	select {
+	case infos := <-listed:
+		if len(infos) != 1 || infos[0].ContainerId != "counter" {
+			t.Fatalf("list() = %+v", infos)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("list() waited for the runner's lock")
+	}
+}
+
+func TestStop(t *testing.T) {
+	d := New()
+	r, err := d.add("counter", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.stop("redis"); err == nil {
+		t.Fatal("Stopped a container that is not hosted")
+	}
+
+	// Already stopped
+	if err := d.stop("counter"); err != nil {
+		t.Fatal(err)
+	}
+	if status := r.Status(); status != runner_context.Stopped {
+		t.Fatalf("Status() = %s, want Stopped", status)
+	}
+
+	// Standbys are stopped, as they have no container to kill
+	if err := r.SetStatus(runner_context.StandBy); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.stop("counter"); err != nil {
+		t.Fatal(err)
+	}
+	if status := r.Status(); status != runner_context.Stopped {
+		t.Fatalf("Status() = %s, want Stopped", status)
+	}
+
+	// Runners without a container to kill are not terminated
+	for _, status := range []runner_context.RunnerStatus{
+		runner_context.StandBy,
+		runner_context.Joining,
+	} {
+		if err := r.SetStatus(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.stop("counter"); err == nil {
+		t.Fatal("Stopped a joining runner")
+	}
+	if status := r.Status(); status != runner_context.Joining {
+		t.Fatalf("Status() = %s, want Joining", status)
+	}
+}
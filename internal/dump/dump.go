@@ -1,12 +1,17 @@
 package dump
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"math"
+	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
@@ -19,80 +24,349 @@ import (
 type Dump struct {
 	_type DumpType
 	nr    int
+	// The unique id of a checkpoint, which keeps checkpoints taken on different
+	// hosts from colliding when replicated. Empty for other dumps.
+	id string
+	// The directory holding the dump's directory.
+	dir Dir
 }
 
-// Construct a dump based on a dumpName.
-func FromString(dumpName string) *Dump {
-	re_nr := regexp.MustCompile("[0-9]+")
-	re_type := regexp.MustCompile("[a-z]+")
-	nr, err := strconv.Atoi(re_nr.FindString(dumpName))
-	_type := re_type.FindString(dumpName)
+// Matches the names of dumps, "tX" where t is a dump type character and X is
+// an integer, followed by "-id" for checkpoints.
+var dumpNameRegexp = regexp.MustCompile("^([pd])([0-9]+)$|^(c)([0-9]+)-([0-9a-f]+)$")
+
+// Dir is a directory holding dump directories, and the commit log of the
+// dumps.
+//
+// A standalone runner keeps its dumps directly in the dump path, while each
+// runner of a daemon keeps its dumps in a directory of its own, in the
+// containers directory of the dump path.
+type Dir string
+
+// The directory, in the dump path, holding the dump directories of the
+// containers run by a daemon. Keeping them apart from the dumps of standalone
+// runners keeps container ids from being mistaken for dump names.
+const _CONTAINERS_DIR = "containers"
+
+// Return the dump path.
+func DefaultDir() Dir {
+	return Dir(env.Getenv().DUMP_PATH)
+}
+
+// Return the directory of the dumps of the container.
+// The container id must be valid, see ValidContainerId.
+func ContainerDir(containerId string) Dir {
+	return Dir(path.Join(env.Getenv().DUMP_PATH, _CONTAINERS_DIR, containerId))
+}
+
+// Return the directory of the dumps of the container run by a standalone
+// runner, which is the directory of the container as for containers run by a
+// daemon, so that the runners of a host are isolated. The dump path is used if
+// the container id is not known, e.g. before joining a cluster.
+func RunnerDir(containerId string) Dir {
+	if containerId == "" {
+		return DefaultDir()
+	}
+	return ContainerDir(containerId)
+}
+
+// Return an error if the container id may not be used as the name of the
+// directory of its dumps.
+func ValidContainerId(containerId string) error {
+	if containerId == "" {
+		return errors.New("Container id is empty")
+	}
+	if strings.Contains(containerId, "/") || strings.Contains(containerId, "..") {
+		return errors.Errorf("Container id %q contains invalid characters", containerId)
+	}
+	return nil
+}
+
+func (dir Dir) Path() string {
+	return string(dir)
+}
+
+// Construct a dump in the directory based on a dumpName.
+func (dir Dir) FromString(dumpName string) *Dump {
+	m := dumpNameRegexp.FindStringSubmatch(dumpName)
+	if m == nil {
+		log.Error().Str("Dump", dumpName).Msg("Invalid dump name")
+		return &Dump{dir: dir}
+	}
+	_type, nr, id := m[1], m[2], ""
+	if _type == "" {
+		_type, nr, id = m[3], m[4], m[5]
+	}
+	n, _ := strconv.Atoi(nr)
+	return &Dump{_type: dump_type.FromString(_type), nr: n, id: id, dir: dir}
+}
+
+// Construct the next checkpoint dump, numbered after all checkpoints in the
+// directory, with a random id.
+func (dir Dir) NextCheckpoint() (*Dump, error) {
+	checkpoints, err := dir.Checkpoints()
+	if err != nil {
+		return nil, err
+	}
+	nr := 0
+	for _, d := range checkpoints {
+		if d.nr >= nr {
+			nr = d.nr + 1
+		}
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "Failed to generate checkpoint id")
+	}
+	return &Dump{
+		_type: dump_type.Checkpoint,
+		nr:    nr,
+		id:    hex.EncodeToString(id),
+		dir:   dir,
+	}, nil
+}
+
+// Return the number after the numbers of all pre-dumps and full dumps in the
+// directory, and in its commit log, e.g. to number the dumps taken after
+// restoring from a checkpoint.
+func (dir Dir) nextNr() int {
+	nr := 0
+	names := []string{}
+	if entries, err := ioutil.ReadDir(dir.Path()); err == nil {
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+	}
+	if content, err := ioutil.ReadFile(path.Join(dir.Path(), _COMMIT_LOG)); err == nil {
+		names = append(names, strings.Fields(string(content))...)
+	}
+	for _, name := range names {
+		if !IsDumpName(name) {
+			continue
+		}
+		if d := dir.FromString(name); !d.Checkpoint() && d.nr >= nr {
+			nr = d.nr + 1
+		}
+	}
+	return nr
+}
+
+// Retrieve all checkpoint dumps in the directory, ordered from the earliest to
+// the latest.
+func (dir Dir) Checkpoints() ([]*Dump, error) {
+	entries, err := ioutil.ReadDir(dir.Path())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read dump directory")
+	}
+	dumps := []*Dump{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !IsDumpName(entry.Name()) {
+			continue
+		}
+		if d := dir.FromString(entry.Name()); d.Checkpoint() {
+			dumps = append(dumps, d)
+		}
+	}
+	sort.Slice(dumps, func(i, j int) bool {
+		if dumps[i].nr != dumps[j].nr {
+			return dumps[i].nr < dumps[j].nr
+		}
+		return dumps[i].id < dumps[j].id
+	})
+	return dumps, nil
+}
+
+// The name of the file, in the dump directory, listing the committed dumps.
+const _COMMIT_LOG = "committed"
+
+// Guards the commit log.
+var commitLock sync.Mutex
+
+// Return whether or not the name is a valid name of a dump, i.e. of the form
+// "tX" where t is a dump type character and X is an integer, or "cX-id" for
+// checkpoints.
+func IsDumpName(name string) bool {
+	return dumpNameRegexp.MatchString(name)
+}
+
+// Commit the dump, marking it as completely transferred to this host and thus
+// possible to recover from.
+//
+// Committed dumps are added to the commit log in the dump's directory, so that
+// they survive restarts of the runner. The log is compacted as it is rewritten.
+func (dump Dump) Commit() error {
+	fi, err := os.Stat(dump.Path())
 	if err != nil {
-		log.Error().Str("Error", err.Error()).Send()
+		return errors.Wrapf(err, "Failed to find dump %s", dump.Base())
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("Dump %s is not a directory", dump.Base())
 	}
-	_dumpType := dump_type.FromString(_type)
 
-	return &Dump{_type: _dumpType, nr: nr}
+	commitLock.Lock()
+	defer commitLock.Unlock()
+	logPath := path.Join(dump.dir.Path(), _COMMIT_LOG)
+	content, err := ioutil.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed to read commit log")
+	}
+	names := dump.dir.compactCommitLog(
+		append(strings.Fields(string(content)), dump.Base()),
+	)
+
+	// Write the log under a temporary name and rename it, so that a crash never
+	// leaves a partially written log behind.
+	f, err := ioutil.TempFile(dump.dir.Path(), "."+_COMMIT_LOG)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create commit log")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	for _, name := range names {
+		if _, err := fmt.Fprintln(f, name); err != nil {
+			return errors.Wrap(err, "Failed to write commit log")
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "Failed to sync commit log")
+	}
+	if err := f.Chmod(0644); err != nil {
+		return errors.Wrap(err, "Failed to write commit log")
+	}
+	if err := os.Rename(f.Name(), logPath); err != nil {
+		return errors.Wrap(err, "Failed to write commit log")
+	}
+	log.Debug().
+		Str("Dump", dump.Base()).
+		Int("Committed", len(names)).
+		Msg("Dump committed")
+	return nil
 }
 
-// Construct a checkpoint dump from another dump.
-func (dump *Dump) Checkpoint() *Dump {
-	return &Dump{_type: dump_type.Checkpoint, nr: dump.nr + 1}
+// Return the names of the commit log without the entries that are invalid,
+// repeated or whose dumps have been removed, so that the log does not grow
+// with every dump. The latest pre-dump or full dump is always kept, as dumps
+// are numbered after it.
+func (dir Dir) compactCommitLog(names []string) []string {
+	latest := ""
+	latestNr := -1
+	for _, name := range names {
+		if !IsDumpName(name) {
+			continue
+		}
+		if d := dir.FromString(name); !d.Checkpoint() && d.nr > latestNr {
+			latest = name
+			latestNr = d.nr
+		}
+	}
+
+	compacted := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !IsDumpName(name) || seen[name] {
+			continue
+		}
+		if _, err := os.Stat(path.Join(dir.Path(), name)); err != nil &&
+			name != latest {
+			continue
+		}
+		seen[name] = true
+		compacted = append(compacted, name)
+	}
+	return compacted
 }
 
-// Retrieve the latest dump possible to recover from, i.e. the last transferred
-// full dump.
+// Retrieve the dumps in the directory possible to recover from, i.e. the
+// committed full dumps, ordered from the latest to the earliest.
 //
-// The latest possible dump to recover from is determined by finding the
-// directory fullfilling:
-// 1) its name starts with the character 'd', i.e. the name is of the form
-// "dX" (where X is an integer)
-// 2) It has the highest number in its name of all full dumps (directories
-// prefixed with 'd'), i.e. for all directories of the form "dX", its X is
-// maximal.
-func Recover() (*Dump, error) {
-	entries, err := ioutil.ReadDir(env.Getenv().DUMP_PATH)
+// Dumps are only committed after they, and the rest of their chain, have been
+// completely transferred. Dumps that were not committed, e.g. because the
+// transfer was cut off halfway, are never recovered from.
+func (dir Dir) Recoverable() ([]*Dump, error) {
+	commitLock.Lock()
+	defer commitLock.Unlock()
+	content, err := ioutil.ReadFile(path.Join(dir.Path(), _COMMIT_LOG))
 	if err != nil {
-		log.Error().
-			Str("Error", err.Error()).
-			Msg("Failed to read recovery directory")
+		return nil, errors.Wrap(err, "Failed to read commit log")
 	}
 
-	// Find the directory that fullfills the requirements described in the
-	// function comment.
-	latestDumpNum := math.Inf(-1)
-	r := regexp.MustCompile("[0-9]+")
-	for _, entry := range entries {
-		num, _ := strconv.Atoi(r.FindString(entry.Name()))
-		if entry.IsDir() && entry.Name()[0] == 'd' && float64(num) > latestDumpNum {
-			latestDumpNum = float64(num)
+	dumps := []*Dump{}
+	seen := map[int]bool{}
+	for _, name := range strings.Fields(string(content)) {
+		if !IsDumpName(name) {
+			log.Warn().Str("Dump", name).Msg("Invalid dump name in commit log")
+			continue
+		}
+		d := dir.FromString(name)
+		if d._type == dump_type.FullDump && !seen[d.nr] {
+			seen[d.nr] = true
+			dumps = append(dumps, d)
 		}
 	}
-	if latestDumpNum == math.Inf(-1) {
-		return nil, errors.New("Failed to find a dump directory")
+	if len(dumps) == 0 {
+		return nil, errors.New("Failed to find a committed full dump")
 	}
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].nr > dumps[j].nr })
 
-	latestDump := fmt.Sprintf("d%d", int(latestDumpNum))
 	log.Debug().
-		Str("Dump", latestDump).
+		Str("Dump", dumps[0].Base()).
+		Int("Candidates", len(dumps)).
 		Msg("Latest possible recovery dump determined")
-	return &Dump{_type: dump_type.FullDump, nr: int(latestDumpNum)}, nil
+	return dumps, nil
 }
 
 func (dump Dump) Path() string {
-	return path.Join(env.Getenv().DUMP_PATH, dump.Base())
+	return path.Join(dump.dir.Path(), dump.Base())
 }
 
 func (dump Dump) Base() string {
 	prefix := dump._type.ToChar()
+	if dump.id != "" {
+		return fmt.Sprintf("%c%d-%s", prefix, dump.nr, dump.id)
+	}
 	return fmt.Sprintf("%c%d", prefix, dump.nr)
 }
 
+// Return the total size, in bytes, of the files in the dump directory.
+func (dump Dump) Size() (int64, error) {
+	entries, err := ioutil.ReadDir(dump.Path())
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to read dump directory")
+	}
+	var size int64
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			size += entry.Size()
+		}
+	}
+	return size, nil
+}
+
+// Return the number of the dump.
+func (dump Dump) Nr() int {
+	return dump.nr
+}
+
 // Return whether of not the dump is a predump
 func (dump Dump) PreDump() bool {
 	return dump._type == dump_type.PreDump
 }
 
+// Return whether of not the dump is a checkpoint
+func (dump Dump) Checkpoint() bool {
+	return dump._type == dump_type.Checkpoint
+}
+
+// Return the number of the dump following this dump. Checkpoints are numbered
+// separately from the other dumps, so dumps following a checkpoint are
+// numbered after all dumps in the directory.
+func (dump Dump) nextNr() int {
+	if dump.Checkpoint() {
+		return dump.dir.nextNr()
+	}
+	return dump.nr + 1
+}
+
 // Return the next dump to dump based on this dump and the current chain
 // length.
 func (dump Dump) NextDump(chainLength int) *Dump {
@@ -101,27 +375,33 @@ func (dump Dump) NextDump(chainLength int) *Dump {
 	if chainLength < maxChainLength-1 {
 		t = dump_type.PreDump
 	}
-	return &Dump{_type: t, nr: dump.nr + 1}
+	return &Dump{_type: t, nr: dump.nextNr(), dir: dump.dir}
 }
 
 // Return the next pre-dump based on this dump.
 func (dump Dump) NextPreDump() *Dump {
-	return &Dump{_type: dump_type.PreDump, nr: dump.nr + 1}
+	return &Dump{_type: dump_type.PreDump, nr: dump.nextNr(), dir: dump.dir}
 }
 
 // Return the next full dump based on this dump.
 func (dump Dump) NextFullDump() *Dump {
-	return &Dump{_type: dump_type.FullDump, nr: dump.nr + 1}
+	return &Dump{_type: dump_type.FullDump, nr: dump.nextNr(), dir: dump.dir}
 }
 
-// Return the first of all dumps, across all hosts.
-func FirstDump() *Dump {
-	return &Dump{_type: dump_type.PreDump, nr: 0}
+// Return the first of all dumps in the directory, across all hosts.
+func (dir Dir) FirstDump() *Dump {
+	return &Dump{_type: dump_type.PreDump, nr: 0, dir: dir}
 }
 
-// Return the first dump of the next chain
+// Return the first dump of the next chain, numbered after this dump and after
+// all dumps in the directory, as the container may have been restored from an
+// earlier dump than the latest.
 func (dump Dump) NextChainDump() *Dump {
-	return &Dump{_type: dump_type.PreDump, nr: dump.nr + 1}
+	nr := dump.nextNr()
+	if dirNr := dump.dir.nextNr(); dirNr > nr {
+		nr = dirNr
+	}
+	return &Dump{_type: dump_type.PreDump, nr: nr, dir: dump.dir}
 }
 
 // Return the dump represented as a parent path to another dump.
@@ -0,0 +1,190 @@
+package dump
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFromString(t *testing.T) {
+	dir := Dir("/dumps")
+	tests := []struct {
+		name       string
+		valid      bool
+		nr         int
+		preDump    bool
+		checkpoint bool
+	}{
+		{"p0", true, 0, true, false},
+		{"d12", true, 12, false, false},
+		{"c3-0a1b2c3d", true, 3, false, true},
+		{"c3", false, 0, false, false},
+		{"d3-0a1b2c3d", false, 0, false, false},
+		{"c3-xyz", false, 0, false, false},
+		{"x1", false, 0, false, false},
+		{"d", false, 0, false, false},
+		{"../d1", false, 0, false, false},
+		{"", false, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if valid := IsDumpName(tt.name); valid != tt.valid {
+				t.Fatalf("IsDumpName(%q) = %t, want %t", tt.name, valid, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+			d := dir.FromString(tt.name)
+			if d.Base() != tt.name {
+				t.Fatalf("Base() = %q, want %q", d.Base(), tt.name)
+			}
+			if d.Path() != path.Join("/dumps", tt.name) {
+				t.Fatalf("Path() = %q", d.Path())
+			}
+			if d.Nr() != tt.nr || d.PreDump() != tt.preDump ||
+				d.Checkpoint() != tt.checkpoint {
+				t.Fatalf("FromString(%q) = %+v", tt.name, d)
+			}
+		})
+	}
+}
+
+func TestValidContainerId(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"counter", true},
+		{"counter-1.2_3", true},
+		{"", false},
+		{"a/b", false},
+		{"/abs", false},
+		{"..", false},
+		{"a..b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if err := ValidContainerId(tt.id); (err == nil) != tt.valid {
+				t.Fatalf("ValidContainerId(%q) = %v, want valid %t", tt.id, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestRunnerDir(t *testing.T) {
+	if dir := RunnerDir(""); dir != DefaultDir() {
+		t.Fatalf("RunnerDir(\"\") = %s, want %s", dir, DefaultDir())
+	}
+	want := path.Join(DefaultDir().Path(), _CONTAINERS_DIR, "counter")
+	if dir := RunnerDir("counter"); dir.Path() != want {
+		t.Fatalf("RunnerDir(\"counter\") = %s, want %s", dir, want)
+	}
+}
+
+// Create the dump directories, and commit the committed dumps.
+func TestCompactCommitLog(t *testing.T) {
+	dir := Dir(t.TempDir())
+	createDumps(t, dir, []string{"d1", "d3", "c0-ab"}, []string{"d1", "d3", "d1"})
+	for _, name := range []string{"d1", "d3"} {
+		if err := os.RemoveAll(dir.FromString(name).Path()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dir.FromString("c0-ab").Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The removed dumps are dropped, except for the latest one, which the dumps
+	// are numbered after.
+	content, err := ioutil.ReadFile(path.Join(dir.Path(), _COMMIT_LOG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "d3\nc0-ab\n" {
+		t.Errorf("Commit log = %q, want %q", content, "d3\nc0-ab\n")
+	}
+	if nr := dir.nextNr(); nr != 4 {
+		t.Errorf("nextNr() = %d, want 4", nr)
+	}
+}
+
+func createDumps(t *testing.T, dir Dir, names []string, committed []string) {
+	for _, name := range names {
+		if err := os.MkdirAll(dir.FromString(name).Path(), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range committed {
+		if err := dir.FromString(name).Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNextCheckpoint(t *testing.T) {
+	dir := Dir(t.TempDir())
+	createDumps(t, dir, []string{"d4", "c0-00000000", "c2-ffffffff"}, nil)
+
+	a, err := dir.NextCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := dir.NextCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Nr() != 3 || !a.Checkpoint() || !IsDumpName(a.Base()) {
+		t.Fatalf("NextCheckpoint() = %s, want checkpoint 3", a.Base())
+	}
+	if a.Base() == b.Base() {
+		t.Fatalf("NextCheckpoint() returned %s twice", a.Base())
+	}
+
+	checkpoints, err := dir.Checkpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints) != 2 || checkpoints[0].Base() != "c0-00000000" ||
+		checkpoints[1].Base() != "c2-ffffffff" {
+		t.Fatalf("Checkpoints() = %v", checkpoints)
+	}
+}
+
+// Dumps taken after restoring from a checkpoint must not reuse the names of
+// the dumps in the directory, or in its commit log.
+func TestNextAfterCheckpoint(t *testing.T) {
+	dir := Dir(t.TempDir())
+	createDumps(t, dir, []string{"p5", "d6", "c9-0a1b2c3d"}, nil)
+	if err := ioutil.WriteFile(
+		path.Join(dir.Path(), _COMMIT_LOG),
+		[]byte("d6\nd7\n"),
+		0644,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := dir.FromString("c9-0a1b2c3d")
+	if next := checkpoint.NextPreDump(); next.Base() != "p8" {
+		t.Fatalf("NextPreDump() = %s, want p8", next.Base())
+	}
+	if next := dir.FromString("d6").NextPreDump(); next.Base() != "p7" {
+		t.Fatalf("NextPreDump() = %s, want p7", next.Base())
+	}
+}
+
+func TestRecoverable(t *testing.T) {
+	dir := Dir(t.TempDir())
+	if _, err := dir.Recoverable(); err == nil {
+		t.Fatal("Recoverable() succeeded without a commit log")
+	}
+
+	createDumps(t, dir, []string{"p0", "d1", "p2", "d3"}, []string{"p0", "d1", "d3", "d1"})
+	dumps, err := dir.Recoverable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumps) != 2 || dumps[0].Base() != "d3" || dumps[1].Base() != "d1" {
+		t.Fatalf("Recoverable() = %v, want [d3 d1]", dumps)
+	}
+}
@@ -6,21 +6,40 @@ import (
 	"math"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/codec"
+	"github.com/Xarepo/msc-container-migration/internal/logger"
+	"github.com/Xarepo/msc-container-migration/internal/utils"
 )
 
 type _env struct {
 	ENABLE_CONTINOUS_DUMPING                         bool
 	LOG_LEVEL                                        string
 	DUMP_PATH                                        string
+	SOCKET_DIR                                       string
 	SSH_USER, SSH_PASSWORD                           string
-	RPC_PORT                                         int
+	SSH_KEY, SSH_AUTH_SOCK                           string
+	SSH_HOST_KEY, SSH_AUTHORIZED_KEYS                string
+	SSH_KNOWN_HOSTS                                  string
+	TRANSPORT                                        string
+	COMPRESSION                                      []string
+	DEDUPLICATION                                    bool
+	RPC_PORT, FILE_TRANSFER_PORT                     int
+	RPC_IP, FILE_TRANSFER_IP                         string
+	RPC_ADVERTISE_HOST, FILE_TRANSFER_ADVERTISE_HOST string
+	RPC_ADVERTISE_PORT, FILE_TRANSFER_ADVERTISE_PORT int
 	CRIU_TCP_ESTABLISHED                             bool
+	PRE_DUMP_TIMEOUT, DUMP_TIMEOUT                   int
+	RESTORE_TIMEOUT, KILL_TIMEOUT                    int
 	DUMP_INTERVAL                                    int
 	PING_INTERVAL, PING_TIMEOUT, PING_TIMEOUT_SOURCE int
 	CHAIN_LENGTH                                     int
+	MIGRATION_MAX_ROUNDS, MIGRATION_DELTA_SIZE       int
+	MIGRATION_DELTA_RATIO                            float64
 }
 
 var env _env
@@ -30,13 +49,27 @@ const (
 	_DEFAULT_ENABLE_CONTINOUS_DUMPING = true
 	_DEFAULT_LOG_LEVEL                = "info"
 	_DEFAULT_DUMP_PATH                = "/dumps"
+	_DEFAULT_SOCKET_DIR               = "/tmp/msc"
+	_DEFAULT_TRANSPORT                = "sftp"
+	_DEFAULT_COMPRESSION              = "zstd,gzip,none"
+	_DEFAULT_DEDUPLICATION            = true
+	_DEFAULT_RPC_IP                   = "" // All interfaces
 	_DEFAULT_RPC_PORT                 = 1234
+	_DEFAULT_FILE_TRANSFER_IP         = "" // All interfaces
+	_DEFAULT_FILE_TRANSFER_PORT       = 2022
 	_DEFAULT_DUMP_INTERVAL            = 5
 	_DEFAULT_PING_INTERVAL            = 1
 	_DEFAULT_PING_TIMEOUT             = 5
 	_DEFAULT_CRIU_TCP_ESTABLISHED     = false
+	_DEFAULT_PRE_DUMP_TIMEOUT         = 300
+	_DEFAULT_DUMP_TIMEOUT             = 300
+	_DEFAULT_RESTORE_TIMEOUT          = 300
+	_DEFAULT_KILL_TIMEOUT             = 10
 	_DEFAULT_PING_TIMEOUT_SOURCE      = 3
 	_DEFAULT_CHAIN_LENGTH             = 3
+	_DEFAULT_MIGRATION_MAX_ROUNDS     = 5
+	_DEFAULT_MIGRATION_DELTA_SIZE     = 1 << 20 // 1 MiB
+	_DEFAULT_MIGRATION_DELTA_RATIO    = 0.1
 )
 
 // Initialize the environment.
@@ -48,21 +81,79 @@ func Init() error {
 	log.Trace().Msg("Initializing environment")
 	env.LOG_LEVEL = getString("LOG_LEVEL", _DEFAULT_LOG_LEVEL)
 	env.DUMP_PATH = getString("DUMP_PATH", _DEFAULT_DUMP_PATH)
+	env.SOCKET_DIR = getString("SOCKET_DIR", _DEFAULT_SOCKET_DIR)
 
-	env.SSH_USER, err = getStringRequired("SSH_USER")
+	env.TRANSPORT = getString("TRANSPORT", _DEFAULT_TRANSPORT)
+	env.COMPRESSION, err = getCodecs("COMPRESSION", _DEFAULT_COMPRESSION)
 	if err != nil {
 		return err
 	}
-	env.SSH_PASSWORD, err = getStringRequired("SSH_PASSWORD")
+	env.DEDUPLICATION, err = getBool("DEDUPLICATION", _DEFAULT_DEDUPLICATION)
 	if err != nil {
 		return err
 	}
 
+	env.SSH_USER = getString("SSH_USER", "")
+	env.SSH_PASSWORD = getSecret("SSH_PASSWORD")
+	env.SSH_KEY = getString("SSH_KEY", "")
+	env.SSH_AUTH_SOCK = getString("SSH_AUTH_SOCK", "")
+	env.SSH_HOST_KEY = getString("SSH_HOST_KEY", "")
+	env.SSH_AUTHORIZED_KEYS = getString("SSH_AUTHORIZED_KEYS", "")
+	env.SSH_KNOWN_HOSTS = getString("SSH_KNOWN_HOSTS", "")
+	// The credentials to receive dumps with are only needed if they are
+	// received over SFTP. The credentials to send dumps with are checked when a
+	// target receiving dumps over SFTP joins, as targets may use any transport.
+	if env.TRANSPORT == "sftp" {
+		if env.SSH_USER == "" {
+			return errors.New("SSH_USER must be set to receive dumps over SFTP")
+		}
+		if env.SSH_PASSWORD == "" && env.SSH_AUTHORIZED_KEYS == "" {
+			return errors.New(
+				"One of SSH_PASSWORD and SSH_AUTHORIZED_KEYS must be set" +
+					" to receive dumps over SFTP",
+			)
+		}
+	}
+
+	env.RPC_IP = getString("RPC_IP", _DEFAULT_RPC_IP)
 	env.RPC_PORT, err = getInt("RPC_PORT", _DEFAULT_RPC_PORT)
 	if err != nil {
 		return err
 	}
 
+	env.FILE_TRANSFER_IP = getString("FILE_TRANSFER_IP", _DEFAULT_FILE_TRANSFER_IP)
+	env.FILE_TRANSFER_PORT, err = getInt(
+		"FILE_TRANSFER_PORT",
+		_DEFAULT_FILE_TRANSFER_PORT,
+	)
+	if err != nil {
+		return err
+	}
+
+	// The addresses advertised to other nodes default to the local IP and the
+	// ports listened on, but differ when e.g. behind NAT.
+	env.RPC_ADVERTISE_HOST = getString("RPC_ADVERTISE_HOST", utils.GetLocalIP())
+	if env.RPC_ADVERTISE_HOST == "" {
+		return errors.New(
+			"Failed to determine the local IP, RPC_ADVERTISE_HOST must be set",
+		)
+	}
+	env.RPC_ADVERTISE_PORT, err = getInt("RPC_ADVERTISE_PORT", env.RPC_PORT)
+	if err != nil {
+		return err
+	}
+	env.FILE_TRANSFER_ADVERTISE_HOST = getString(
+		"FILE_TRANSFER_ADVERTISE_HOST",
+		env.RPC_ADVERTISE_HOST,
+	)
+	env.FILE_TRANSFER_ADVERTISE_PORT, err = getInt(
+		"FILE_TRANSFER_ADVERTISE_PORT",
+		env.FILE_TRANSFER_PORT,
+	)
+	if err != nil {
+		return err
+	}
+
 	env.DUMP_INTERVAL, err = getInt("DUMP_INTERVAL", _DEFAULT_DUMP_INTERVAL)
 	if err != nil {
 		return err
@@ -98,11 +189,53 @@ func Init() error {
 		return err
 	}
 
+	env.PRE_DUMP_TIMEOUT, err = getInt("PRE_DUMP_TIMEOUT", _DEFAULT_PRE_DUMP_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	env.DUMP_TIMEOUT, err = getInt("DUMP_TIMEOUT", _DEFAULT_DUMP_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	env.RESTORE_TIMEOUT, err = getInt("RESTORE_TIMEOUT", _DEFAULT_RESTORE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	env.KILL_TIMEOUT, err = getInt("KILL_TIMEOUT", _DEFAULT_KILL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
 	env.CHAIN_LENGTH, err = getInt("CHAIN_LENGTH", _DEFAULT_CHAIN_LENGTH)
 	if err != nil {
 		return err
 	}
 
+	env.MIGRATION_MAX_ROUNDS, err = getInt(
+		"MIGRATION_MAX_ROUNDS",
+		_DEFAULT_MIGRATION_MAX_ROUNDS,
+	)
+	if err != nil {
+		return err
+	}
+	if env.MIGRATION_MAX_ROUNDS < 1 {
+		return errors.New("MIGRATION_MAX_ROUNDS must be at least 1")
+	}
+	env.MIGRATION_DELTA_SIZE, err = getInt(
+		"MIGRATION_DELTA_SIZE",
+		_DEFAULT_MIGRATION_DELTA_SIZE,
+	)
+	if err != nil {
+		return err
+	}
+	env.MIGRATION_DELTA_RATIO, err = getFloat(
+		"MIGRATION_DELTA_RATIO",
+		_DEFAULT_MIGRATION_DELTA_RATIO,
+	)
+	if err != nil {
+		return err
+	}
+
 	env.ENABLE_CONTINOUS_DUMPING, err = getBool(
 		"ENABLE_CONTINOUS_DUMPING",
 		_DEFAULT_ENABLE_CONTINOUS_DUMPING,
@@ -130,12 +263,26 @@ func getString(name, defaultValue string) string {
 	return val
 }
 
-func getStringRequired(name string) (string, error) {
+// Return the value of a variable that must not be logged.
+func getSecret(name string) string {
 	val := os.Getenv(name)
-	if val == "" {
-		return "", errors.Errorf("Required environment variable %s not set", name)
+	if val != "" {
+		logger.Redact(val)
 	}
-	return val, nil
+	return val
+}
+
+// Return a comma separated list of codec names, which must all be available.
+func getCodecs(name, defaultValue string) ([]string, error) {
+	codecs := []string{}
+	for _, c := range strings.Split(getString(name, defaultValue), ",") {
+		c = strings.TrimSpace(c)
+		if _, err := codec.New(c); err != nil || c == "" {
+			return nil, errors.Errorf("Unknown codec %q in %s", c, name)
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs, nil
 }
 
 func getInt(name string, defaultValue int) (int, error) {
@@ -160,6 +307,27 @@ func getInt(name string, defaultValue int) (int, error) {
 	return valInt, nil
 }
 
+func getFloat(name string, defaultValue float64) (float64, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		log.Warn().
+			Str("Variable", name).
+			Float64("DefaultValue", defaultValue).
+			Msg("Environment variable not set, using default value")
+		return defaultValue, nil
+	}
+
+	valFloat, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return math.NaN(), errors.Wrapf(
+			err,
+			"Failed to parse float from environment variable %s",
+			name,
+		)
+	}
+	return valFloat, nil
+}
+
 func getBool(name string, defaultValue bool) (bool, error) {
 	val := os.Getenv(name)
 	if val == "" {
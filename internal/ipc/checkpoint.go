@@ -1,32 +1,169 @@
 package ipc
 
 import (
-	"fmt"
+	"context"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 
+	chain_node "github.com/Xarepo/msc-container-migration/internal/chain/node"
+	"github.com/Xarepo/msc-container-migration/internal/checkpoint"
+	"github.com/Xarepo/msc-container-migration/internal/chunk"
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
 	"github.com/Xarepo/msc-container-migration/internal/runc"
 	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+	"github.com/Xarepo/msc-container-migration/internal/transport"
 )
 
 type Checkpoint struct {
+	// The name of the checkpoint. If empty, the name of the checkpoint's dump
+	// is used.
+	Name string
+	// Whether or not to copy the checkpoint to the targets of the runner.
+	Replicate bool
 }
 
-func (cp Checkpoint) Send() {
-	msg := []byte(fmt.Sprintf("%s", IPC_CHECKPOINT))
-	sendMessage(&msg)
+// Flags of the checkpoint IPC, passed as "<flag>=<value>" or "<flag>".
+const (
+	_FLAG_NAME      = "--name"
+	_FLAG_REPLICATE = "--replicate"
+)
+
+// CheckpointResult is the result of a successful checkpoint.
+type CheckpointResult struct {
+	checkpoint.Checkpoint
+	// The ids of the targets the checkpoint was copied to.
+	ReplicatedTo []string
 }
 
-func (cp Checkpoint) Execute(ctx *runner_context.RunnerContext) {
+func (cp Checkpoint) Command() string {
+	return IPC_CHECKPOINT
+}
+
+func (cp Checkpoint) Execute(
+	ctx *runner_context.RunnerContext,
+) (interface{}, error) {
 	log.Trace().
+		Str("Name", cp.Name).
+		Bool("Replicate", cp.Replicate).
 		Msg("Executing checkpoint IPC")
+	var result CheckpointResult
+	var targets []remote_target.RemoteTarget
+	var dumpDir dump.Dir
+	var err error
 	// Take lock so that no other routine can dump at the same time
 	ctx.WithLock(func() {
-		checkpointImg := ctx.Chain.Latest().Dump().Checkpoint()
-		runc.Dump(ctx.ContainerId, checkpointImg.Path(), "", true)
+		if ctx.Status() != runner_context.Running {
+			err = errors.Errorf("Runner is %s, not Running", ctx.Status())
+			return
+		}
+		dumpDir = ctx.DumpDir
+		result.Checkpoint, err = cp.create(
+			ctx.RuncContext(),
+			dumpDir,
+			ctx.ContainerId,
+		)
+		targets = append(targets, ctx.Targets...)
 	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to checkpoint")
+	}
+	log.Info().
+		Str("Name", result.Name).
+		Str("Dump", result.Dump).
+		Msg("Checkpoint created")
+
+	if !cp.Replicate {
+		return result, nil
+	}
+	node := chain_node.New(dumpDir.FromString(result.Dump), nil)
+	failed := []string{}
+	for i := range targets {
+		if err := replicate(node, &targets[i]); err != nil {
+			log.Error().
+				Str("Error", err.Error()).
+				Str("Target", targets[i].Id()).
+				Msg("Failed to replicate checkpoint")
+			failed = append(failed, targets[i].Id())
+			continue
+		}
+		result.ReplicatedTo = append(result.ReplicatedTo, targets[i].Id())
+	}
+	if len(failed) > 0 {
+		return nil, errors.Errorf(
+			"Checkpoint %s created, but failed to replicate it to %s",
+			result.Name,
+			strings.Join(failed, ", "),
+		)
+	}
+	return result, nil
+}
+
+// Dump the container into a new checkpoint, leaving it running.
+// Should be called while holding the lock.
+func (cp Checkpoint) create(
+	runcCtx context.Context,
+	dir dump.Dir,
+	containerId string,
+) (checkpoint.Checkpoint, error) {
+	d, err := dir.NextCheckpoint()
+	if err != nil {
+		return checkpoint.Checkpoint{}, err
+	}
+	name := cp.Name
+	if name == "" {
+		name = d.Base()
+	}
+	if err := checkpoint.ValidName(name); err != nil {
+		return checkpoint.Checkpoint{}, err
+	}
+	existing, err := checkpoint.Find(dir, name)
+	if err != nil {
+		return checkpoint.Checkpoint{}, err
+	}
+	if existing != nil {
+		return checkpoint.Checkpoint{}, errors.Errorf(
+			"Checkpoint %s already exists",
+			name,
+		)
+	}
+
+	if err := runc.Dump(runcCtx, containerId, d.Path(), "", true); err != nil {
+		os.RemoveAll(d.Path())
+		return checkpoint.Checkpoint{}, err
+	}
+	created := checkpoint.Checkpoint{
+		Name:        name,
+		Dump:        d.Base(),
+		ContainerId: containerId,
+		Created:     time.Now(),
+	}
+	return created, checkpoint.Write(dir, created)
+}
+
+func replicate(node *chain_node.ChainNode, target *remote_target.RemoteTarget) error {
+	t, err := transport.FromTarget(target)
+	if err != nil {
+		return errors.Wrap(err, "Failed to select transport")
+	}
+	return chunk.TransferDump(t, node, target)
 }
 
 func (cp *Checkpoint) ParseFlags(flags []string) error {
+	for _, flag := range flags {
+		kv := strings.SplitN(flag, "=", 2)
+		switch {
+		case kv[0] == _FLAG_NAME && len(kv) == 2:
+			cp.Name = kv[1]
+		case kv[0] == _FLAG_REPLICATE && len(kv) == 1:
+			cp.Replicate = true
+		default:
+			return errors.Errorf("Invalid flag %s", flag)
+		}
+	}
 	return nil
 }
@@ -1,37 +1,38 @@
 package ipc
 
 import (
+	"encoding/json"
 	"net"
 	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 
 	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
-	"github.com/Xarepo/msc-container-migration/internal/usock_listener"
 )
 
-func sendMessage(msg *[]byte) {
-	sockAddr := usock_listener.SOCK_ADDR
-	c, err := net.DialUnix(
-		"unixgram",
-		nil,
-		&net.UnixAddr{Name: sockAddr, Net: "unixgram"},
-	)
-	if err != nil {
-		log.Error().Str("Error", err.Error()).Msgf("Failed to connect IPC socket")
-		panic(err)
-	}
-	defer c.Close()
+// Request is sent by the CLI to the runner's control socket, as a single line
+// of JSON.
+type Request struct {
+	Command string
+	Args    json.RawMessage
+}
 
-	_, err = c.Write(*msg)
-	if err != nil {
-		log.Error().Msgf("Failed to write to socket: %s", err.Error())
-	}
+// Response is written by the runner in reply to a request, as a single line
+// of JSON. Exactly one of Result and Error is set.
+type Response struct {
+	Result json.RawMessage `json:",omitempty"`
+	Error  string          `json:",omitempty"`
 }
 
 type IPC interface {
-	Send()
-	Execute(RunnerContext *runner_context.RunnerContext)
+	// The name of the IPC, one of the available IPCs below.
+	Command() string
+	// Execute the IPC and return its result, which is encoded as JSON in the
+	// response.
+	Execute(RunnerContext *runner_context.RunnerContext) (interface{}, error)
+	// Parse the flags of the IPC from the plain text format accepted on the
+	// datagram socket.
 	ParseFlags([]string) error
 }
 
@@ -39,18 +40,132 @@ type IPC interface {
 const (
 	IPC_MIGRATE    = "MIGRATE"
 	IPC_CHECKPOINT = "CHECKPOINT"
+	IPC_STATUS     = "STATUS"
 )
 
-func ParseIPC(message string) IPC {
-	fields := strings.Split(message, " ")
-	var ipc IPC = nil
+// Send the IPC to the runner's control socket at the address and wait for the
+// response.
+// The result of the IPC is decoded into result, unless result is nil. If the
+// IPC failed the error returned by the runner is returned.
+func Send(sockAddr string, ipc IPC, result interface{}) error {
+	return SendRequest(sockAddr, ipc.Command(), ipc, result)
+}
+
+// Send a request with the command and arguments to the control socket at the
+// address and wait for the response, e.g. to send requests to a daemon.
+// The result is decoded into result, unless result is nil. If the request
+// failed the error returned by the receiver is returned.
+func SendRequest(
+	sockAddr, command string,
+	args interface{},
+	result interface{},
+) error {
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode IPC")
+	}
+
+	c, err := net.Dial("unix", sockAddr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to runner at %s", sockAddr)
+	}
+	defer c.Close()
+
+	err = json.NewEncoder(c).Encode(Request{Command: command, Args: encoded})
+	if err != nil {
+		return errors.Wrap(err, "Failed to write request")
+	}
+
+	var res Response
+	if err := json.NewDecoder(c).Decode(&res); err != nil {
+		return errors.Wrap(err, "Failed to read response")
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	if result != nil && res.Result != nil {
+		if err := json.Unmarshal(res.Result, result); err != nil {
+			return errors.Wrap(err, "Failed to decode result")
+		}
+	}
+	return nil
+}
+
+// Handle a request read from the control socket and return the encoded
+// response.
+func HandleRequest(buf []byte, ctx *runner_context.RunnerContext) []byte {
+	return Serve(buf, func(command string, args json.RawMessage) (interface{}, error) {
+		ipc, err := newIPC(command)
+		if err != nil {
+			return nil, err
+		}
+		if args != nil {
+			if err := json.Unmarshal(args, ipc); err != nil {
+				return nil, errors.Wrap(err, "Failed to decode arguments")
+			}
+		}
+		return ipc.Execute(ctx)
+	})
+}
+
+// Decode a request, execute it and return the encoded response.
+func Serve(
+	buf []byte,
+	execute func(command string, args json.RawMessage) (interface{}, error),
+) []byte {
+	res := serve(buf, execute)
+	if res.Error != "" {
+		log.Error().Str("Error", res.Error).Msg("IPC failed")
+	}
+	out, err := json.Marshal(res)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Failed to encode IPC response")
+		out, _ = json.Marshal(Response{Error: err.Error()})
+	}
+	return out
+}
+
+func serve(
+	buf []byte,
+	execute func(command string, args json.RawMessage) (interface{}, error),
+) Response {
+	var req Request
+	if err := json.Unmarshal(buf, &req); err != nil {
+		return Response{Error: errors.Wrap(err, "Failed to decode request").Error()}
+	}
+	log.Info().Str("Command", req.Command).Msg("Received command")
+
+	result, err := execute(req.Command, req.Args)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		return Response{Error: errors.Wrap(err, "Failed to encode result").Error()}
+	}
+	return Response{Result: out}
+}
 
-	switch fields[0] {
+func newIPC(command string) (IPC, error) {
+	switch command {
 	case IPC_MIGRATE:
-		ipc = &Migrate{}
+		return &Migrate{}, nil
 	case IPC_CHECKPOINT:
-		ipc = &Checkpoint{}
+		return &Checkpoint{}, nil
+	case IPC_STATUS:
+		return &Status{}, nil
 	default:
+		return nil, errors.Errorf("Unknown IPC %s", command)
+	}
+}
+
+// Parse an IPC from the plain text format accepted on the datagram socket,
+// i.e. the name of the IPC followed by its space separated flags.
+func ParseIPC(message string) IPC {
+	fields := strings.Split(strings.TrimSpace(message), " ")
+
+	ipc, err := newIPC(fields[0])
+	if err != nil {
 		log.Error().Str("IPC", fields[0]).Msg("Received unknown IPC")
 		return nil
 	}
@@ -1,9 +1,10 @@
 package ipc
 
 import (
-	"errors"
-	"fmt"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 
 	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
@@ -11,18 +12,99 @@ import (
 
 type Migrate struct {
 	ContainerId string
+	// The RPC address of the target to migrate to. If empty, the first target
+	// is used.
+	To string
+	// The maximum downtime allowed for the migration. If zero, there is no
+	// limit.
+	MaxDowntime time.Duration
 }
 
-func (migrate Migrate) Send() {
-	msg := []byte(fmt.Sprintf("%s %s", IPC_MIGRATE, migrate.ContainerId))
-	sendMessage(&msg)
+// Flags of the migrate IPC, passed as "<flag>=<value>" after the container id.
+const (
+	_FLAG_TO           = "--to"
+	_FLAG_MAX_DOWNTIME = "--max-downtime"
+)
+
+// MigrateResult is the result of a successful migration.
+type MigrateResult struct {
+	ContainerId string
+	// The RPC address of the target the container was migrated to.
+	Destination string
+}
+
+func (migrate Migrate) Command() string {
+	return IPC_MIGRATE
 }
 
-func (migrate Migrate) Execute(ctx *runner_context.RunnerContext) {
+// Request a migration and wait for it to finish.
+// Returns an error if the migration is refused or aborted.
+func (migrate Migrate) Execute(
+	ctx *runner_context.RunnerContext,
+) (interface{}, error) {
 	log.Trace().
 		Str("ContainerId", migrate.ContainerId).
+		Str("To", migrate.To).
+		Str("MaxDowntime", migrate.MaxDowntime.String()).
 		Msg("Executing migrate IPC")
-	ctx.SetStatus(runner_context.Migrating)
+	var err error
+	ctx.WithLock(func() {
+		if err = migrate.validate(ctx); err != nil {
+			return
+		}
+		err = ctx.SetStatusNoLock(runner_context.Migrating)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Refusing to migrate")
+	}
+
+	result := MigrateResult{
+		ContainerId: migrate.ContainerId,
+		Destination: ctx.MigrationTarget,
+	}
+	<-ctx.Leaving(runner_context.Migrating)
+	var migrationErr error
+	ctx.WithLock(func() {
+		migrationErr = ctx.MigrationError
+	})
+	if migrationErr != nil {
+		return nil, errors.Wrap(migrationErr, "Migration aborted")
+	}
+	if status := ctx.Status(); status != runner_context.Stopped {
+		return nil, errors.Errorf("Migration failed, runner is %s", status)
+	}
+	return result, nil
+}
+
+// Validate the migration request against the context, and set the migration
+// target of the context.
+// Should be called while holding the lock.
+func (migrate Migrate) validate(ctx *runner_context.RunnerContext) error {
+	if ctx.Status() != runner_context.Running {
+		return errors.Errorf("Runner is %s, not Running", ctx.Status())
+	}
+	if migrate.ContainerId != ctx.ContainerId {
+		return errors.Errorf(
+			"Runner is running container %s, not %s",
+			ctx.ContainerId,
+			migrate.ContainerId,
+		)
+	}
+	if len(ctx.Targets) == 0 {
+		return errors.New("There are no targets to migrate to")
+	}
+
+	to := migrate.To
+	if to == "" {
+		to = ctx.Targets[0].Id()
+	}
+	if ctx.GetTarget(to) == nil {
+		return errors.Errorf("%s is not a target of the runner", to)
+	}
+	ctx.MigrationTarget = to
+	ctx.MigrationMaxDowntime = migrate.MaxDowntime
+	ctx.MigrationError = nil
+	return nil
 }
 
 func (migrate *Migrate) ParseFlags(flags []string) error {
@@ -31,6 +113,24 @@ func (migrate *Migrate) ParseFlags(flags []string) error {
 	}
 
 	migrate.ContainerId = flags[0]
+	for _, flag := range flags[1:] {
+		kv := strings.SplitN(flag, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("Invalid flag %s", flag)
+		}
+		switch kv[0] {
+		case _FLAG_TO:
+			migrate.To = kv[1]
+		case _FLAG_MAX_DOWNTIME:
+			d, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return errors.Wrapf(err, "Invalid value of %s", _FLAG_MAX_DOWNTIME)
+			}
+			migrate.MaxDowntime = d
+		default:
+			return errors.Errorf("Unknown flag %s", kv[0])
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,109 @@
+package ipc
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+)
+
+type Status struct {
+}
+
+// StatusResult describes the state of the runner.
+type StatusResult struct {
+	Status      runner_context.RunnerStatus
+	ContainerId string
+	BundlePath  string
+	// The RPC address of the source, only set for standbys.
+	Source string `json:",omitempty"`
+	// The time of the latest ping from the source, only set for standbys.
+	SourceLastPing time.Time
+	// The dumps of the current and previous chain, latest first.
+	Chain, PrevChain []DumpStatus
+	Targets          []TargetStatus
+}
+
+type DumpStatus struct {
+	Name string
+	// The size of the dump directory in bytes, -1 if it could not be read.
+	Size int64
+	// The ids of the targets the dump has been synced to.
+	SyncedTargets []string
+}
+
+type TargetStatus struct {
+	Id        string
+	Transport string
+	// The time of the latest successful ping of the target, the zero time if
+	// it has not yet been pinged.
+	LastPing time.Time
+}
+
+func (status Status) Command() string {
+	return IPC_STATUS
+}
+
+func (status Status) Execute(
+	ctx *runner_context.RunnerContext,
+) (interface{}, error) {
+	log.Trace().Msg("Executing status IPC")
+	// The runner may hold its lock for long, e.g. while migrating, so its
+	// latest snapshot is read instead.
+	snapshot := ctx.Snapshot()
+	result := StatusResult{
+		Status:      ctx.Status(),
+		ContainerId: snapshot.ContainerId,
+		BundlePath:  snapshot.BundlePath,
+		Source:      snapshot.Source,
+		Chain:       dumpStatuses(snapshot.Chain),
+		PrevChain:   dumpStatuses(snapshot.PrevChain),
+		Targets:     []TargetStatus{},
+	}
+	if snapshot.Source != "" {
+		result.SourceLastPing = ctx.SourceLastPing()
+	}
+	for _, target := range snapshot.Targets {
+		result.Targets = append(result.Targets, TargetStatus{
+			Id:        target.Id(),
+			Transport: target.Transport,
+			LastPing:  ctx.LastPing(target.Id()),
+		})
+	}
+
+	readSizes(snapshot.DumpDir, result.Chain)
+	readSizes(snapshot.DumpDir, result.PrevChain)
+	return result, nil
+}
+
+// Return the status of the dumps, without their sizes.
+func dumpStatuses(dumps []runner_context.DumpSnapshot) []DumpStatus {
+	statuses := []DumpStatus{}
+	for _, d := range dumps {
+		statuses = append(statuses, DumpStatus{
+			Name:          d.Name,
+			SyncedTargets: d.SyncedTargets,
+		})
+	}
+	return statuses
+}
+
+func readSizes(dir dump.Dir, statuses []DumpStatus) {
+	for i := range statuses {
+		size, err := dir.FromString(statuses[i].Name).Size()
+		if err != nil {
+			log.Warn().
+				Str("Error", err.Error()).
+				Str("Dump", statuses[i].Name).
+				Msg("Failed to read size of dump")
+			size = -1
+		}
+		statuses[i].Size = size
+	}
+}
+
+func (status *Status) ParseFlags(flags []string) error {
+	return nil
+}
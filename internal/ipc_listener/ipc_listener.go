@@ -1,5 +1,12 @@
 package ipc_listener
 
 type IPCListener interface {
-	Listen(callback func(buf []byte))
+	// Listen for messages on the socket at the address, passing each to the
+	// handler. The response returned by the handler is written back to the
+	// sender, if the listener supports responses.
+	// Blocks until the listener is closed, or returns an error if it fails to
+	// listen.
+	Listen(addr string, handler func(buf []byte) []byte) error
+	// Stop listening, waiting for messages being handled to finish.
+	Close()
 }
@@ -0,0 +1,98 @@
+// Package local_transport transfers dumps by copying them to a directory on
+// the local filesystem, e.g. to run several nodes on one host or to share dumps
+// via a network filesystem.
+package local_transport
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	chain_node "github.com/Xarepo/msc-container-migration/internal/chain/node"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+)
+
+type LocalTransport struct{}
+
+// Copy the dump directory of the node into the dump path of the target.
+func (t *LocalTransport) TransferDump(
+	node *chain_node.ChainNode,
+	target *remote_target.RemoteTarget,
+) error {
+	destDir := path.Join(target.DumpPath, node.Dump().Base())
+	log.Debug().
+		Str("Dump Name", node.Dump().Base()).
+		Str("DestDir", destDir).
+		Msg("Copying dump to local directory")
+
+	if destDir == node.Dump().Path() {
+		log.Trace().Str("DestDir", destDir).Msg("Dump already in place")
+		return nil
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return errors.Wrap(err, "Failed to create dump directory")
+	}
+
+	files, err := filepath.Glob(fmt.Sprintf("%s/*", node.Dump().Path()))
+	if err != nil {
+		return errors.Wrap(err, "Failed to collect files for transfer")
+	}
+	for _, file := range files {
+		dest := path.Join(destDir, path.Base(file))
+		if err := copyFile(file, dest); err != nil {
+			return errors.Wrapf(err, "Failed to copy file %s", file)
+		}
+	}
+	return manifest.Verify(destDir)
+}
+
+// Dumps are written directly into the dump path, so there is nothing to
+// receive.
+func (t *LocalTransport) Receive(addr string) error {
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	log.Trace().Str("File", src).Str("Dest", dest).Msg("Copying file")
+
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dest)
+		return os.Symlink(link, dest)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Copy to a temporary file that replaces, rather than writes to, the
+	// existing file, as it may be a hard link to the file of another dump.
+	part := dest + ".part"
+	out, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part)
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, dest)
+}
@@ -1,17 +1,28 @@
 package logger
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// Written in place of redacted secrets.
+const _REDACTED = "[REDACTED]"
+
+var (
+	secretsLock sync.RWMutex
+	secrets     [][]byte
+)
+
 func InitLogger(level string) error {
 	log.Logger = log.Output(
 		zerolog.ConsoleWriter{
-			Out: os.Stderr, TimeFormat: time.RFC3339,
+			Out: redactWriter{out: os.Stderr}, TimeFormat: time.RFC3339,
 		},
 	)
 	zerolog.SetGlobalLevel(zerolog.InfoLevel) // Default to info level
@@ -21,3 +32,31 @@ func InitLogger(level string) error {
 	}
 	return err
 }
+
+// Redact the secret from all log output written from now on.
+func Redact(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secrets = append(secrets, []byte(secret))
+}
+
+// redactWriter replaces the secrets in everything written to out.
+type redactWriter struct {
+	out io.Writer
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	secretsLock.RLock()
+	redacted := p
+	for _, secret := range secrets {
+		redacted = bytes.ReplaceAll(redacted, secret, []byte(_REDACTED))
+	}
+	secretsLock.RUnlock()
+	if _, err := w.out.Write(redacted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,149 @@
+// Package manifest provides integrity manifests for dump directories.
+//
+// A manifest lists every file of a dump directory with its size and SHA-256
+// checksum, so that a dump can be verified after it has been transferred and
+// before it is restored from.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// The name of the manifest file in the dump directory.
+const FILE_NAME = "manifest.json"
+
+type Entry struct {
+	Name string
+	Size int64
+	// The hex encoded SHA-256 checksum of the file. Empty for symlinks.
+	SHA256 string
+	// The destination of the symlink, if the file is a symlink.
+	Link string
+}
+
+type Manifest struct {
+	Files []Entry
+}
+
+// Create a manifest of all files in the directory.
+func Create(dir string) (*Manifest, error) {
+	files, err := filepath.Glob(fmt.Sprintf("%s/*", dir))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to collect files")
+	}
+
+	m := Manifest{Files: []Entry{}}
+	for _, file := range files {
+		if path.Base(file) == FILE_NAME {
+			continue
+		}
+		entry, err := createEntry(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create entry for %s", file)
+		}
+		m.Files = append(m.Files, *entry)
+	}
+	return &m, nil
+}
+
+// Create a manifest of all files in the directory and write it to the
+// directory.
+func Write(dir string) error {
+	m, err := Create(dir)
+	if err != nil {
+		return err
+	}
+	return Save(dir, m)
+}
+
+// Write the manifest to the directory.
+func Save(dir string, m *Manifest) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode manifest")
+	}
+	err = ioutil.WriteFile(path.Join(dir, FILE_NAME), content, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write manifest")
+	}
+	log.Trace().
+		Str("Dir", dir).
+		Int("Files", len(m.Files)).
+		Msg("Manifest written")
+	return nil
+}
+
+// Read the manifest of the directory.
+func Read(dir string) (*Manifest, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, FILE_NAME))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read manifest")
+	}
+	var m Manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode manifest")
+	}
+	return &m, nil
+}
+
+// Verify that every file listed in the manifest of the directory exists and
+// matches its size and checksum.
+func Verify(dir string) error {
+	m, err := Read(dir)
+	if err != nil {
+		return err
+	}
+	for _, expected := range m.Files {
+		actual, err := createEntry(path.Join(dir, expected.Name))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to verify %s", expected.Name)
+		}
+		if *actual != expected {
+			return errors.Errorf(
+				"File %s does not match manifest (size %d, expected %d)",
+				expected.Name,
+				actual.Size,
+				expected.Size,
+			)
+		}
+	}
+	log.Trace().Str("Dir", dir).Msg("Manifest verified")
+	return nil
+}
+
+func createEntry(file string) (*Entry, error) {
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return nil, err
+	}
+	entry := Entry{Name: fi.Name()}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		entry.Link, err = os.Readlink(file)
+		return &entry, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	entry.Size, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return &entry, nil
+}
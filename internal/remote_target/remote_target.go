@@ -1,29 +1,121 @@
 package remote_target
 
-import "fmt"
+import (
+	"net"
+	"net/rpc"
+	"strconv"
+	"strings"
+)
+
+// The HTTP path prefix of the RPCs of runners hosted by a daemon. The RPCs of
+// standalone runners are served on the default path of net/rpc.
+const _DAEMON_RPC_PATH = "/_msc_/"
 
 type RemoteTarget struct {
-	Host             string
-	RPCPort          int
-	DumpPath         string
+	// The host to call RPCs on, an IP address or a host name.
+	Host    string
+	RPCPort int
+	// The name the target's RPCs are served under, if it is hosted by a
+	// daemon.
+	RPCName  string
+	DumpPath string
+	// The host to transfer dumps to. If empty, dumps are transferred to Host.
+	FileTransferHost string
 	FileTransferPort int
+	// The name of the transport the target receives dumps with.
+	Transport string
+	// The SHA256 fingerprint of the host key of the target's SFTP server.
+	// Dumps are only transferred over SFTP to a server presenting the key.
+	HostKey string
+	// The codecs the target accepts dumps compressed with, in order of
+	// preference.
+	Codecs []string
+	// The codec agreed with the source when the target joined, which dumps
+	// are compressed with when transferred to the target.
+	Codec string
 }
 
-func New(host string, rpcPort int, dumpPath string, fileTransferPort int) RemoteTarget {
+func New(
+	host string,
+	rpcPort int,
+	rpcName string,
+	dumpPath string,
+	fileTransferHost string,
+	fileTransferPort int,
+	transport string,
+) RemoteTarget {
 	return RemoteTarget{
 		Host:             host,
 		RPCPort:          rpcPort,
+		RPCName:          rpcName,
 		DumpPath:         dumpPath,
+		FileTransferHost: fileTransferHost,
 		FileTransferPort: fileTransferPort,
+		Transport:        transport,
+	}
+}
+
+// Return the identity of the target. Targets are identified by their RPC
+// endpoint, so a target that leaves and rejoins the cluster keeps its id.
+//
+// The endpoint is the RPC address of the target, followed by "/<name>" if
+// the target is hosted by a daemon.
+func (target RemoteTarget) Id() string {
+	if target.RPCName == "" {
+		return target.RPCAddr()
+	}
+	return target.RPCAddr() + "/" + target.RPCName
+}
+
+// Connect to the RPC server of the target.
+func (target RemoteTarget) Dial() (*rpc.Client, error) {
+	return Dial(target.Id())
+}
+
+// Connect to the RPC server at the endpoint, of the form "host:port" or
+// "host:port/name".
+func Dial(endpoint string) (*rpc.Client, error) {
+	addr, name := SplitEndpoint(endpoint)
+	return rpc.DialHTTPPath("tcp", addr, RPCPath(name))
+}
+
+// Split the endpoint into its RPC address and name.
+func SplitEndpoint(endpoint string) (string, string) {
+	kv := strings.SplitN(endpoint, "/", 2)
+	if len(kv) == 1 {
+		return kv[0], ""
+	}
+	return kv[0], kv[1]
+}
+
+// Return the HTTP path the RPCs of the runner with the given name are served
+// on.
+func RPCPath(name string) string {
+	if name == "" {
+		return rpc.DefaultRPCPath
 	}
+	return _DAEMON_RPC_PATH + name
+}
+
+// Return the name of the runner whose RPCs are served on the HTTP path, or
+// false if the path is not the path of a runner hosted by a daemon.
+func RPCNameFromPath(path string) (string, bool) {
+	if !strings.HasPrefix(path, _DAEMON_RPC_PATH) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, _DAEMON_RPC_PATH), true
 }
 
 func (target RemoteTarget) RPCAddr() string {
-	return fmt.Sprintf("%s:%d", target.Host, target.RPCPort)
+	return net.JoinHostPort(target.Host, strconv.Itoa(target.RPCPort))
 }
 
 func (target RemoteTarget) FileTransferAddr() string {
-	return fmt.Sprintf("%s:%d", target.Host, target.FileTransferPort)
+	host := target.FileTransferHost
+	if host == "" {
+		host = target.Host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(target.FileTransferPort))
 }
 
 // func (target RemoteTarget) DumpPath() string {
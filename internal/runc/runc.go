@@ -1,61 +1,166 @@
 // Package runc provides wrapper functions for the go-runc library.
+//
+// Operations on containers take a context, which kills runc once it is done.
+// Pre-dumps, dumps, restores and kills are additionally limited by the
+// timeouts configured in the environment. Killing runc does not necessarily
+// kill the CRIU it started, so a container may be left frozen by a dump that
+// was cancelled, or timed out, see Thaw.
 package runc
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	_runc "github.com/containerd/go-runc"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 
 	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
 )
 
+// The interval at which to poll the state of a container.
+const _STATE_POLL_INTERVAL = 100 * time.Millisecond
+
+// Operations on containers, as reported by Error.
+const (
+	OpRun     = "run"
+	OpPreDump = "pre-dump"
+	OpDump    = "dump"
+	OpRestore = "restore"
+	OpKill    = "kill"
+	OpThaw    = "thaw"
+)
+
+// Error is the error of an operation on a container.
+// Operations that were cancelled, or timed out, have the error of their
+// context, i.e. context.Canceled or context.DeadlineExceeded.
+type Error struct {
+	Op          string
+	ContainerId string
+	Err         error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Failed to %s container %s: %s", e.Op, e.ContainerId, e.Err)
+}
+
+func (e *Error) Cause() error  { return e.Err }
+func (e *Error) Unwrap() error { return e.Err }
+
+// ManifestError is the error of writing the manifest of a dump that runc has
+// checkpointed. The container is not left running by a successful final dump,
+// so the dump must be kept, as the container can only be restored from it.
+type ManifestError struct {
+	DumpPath string
+	Err      error
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("Failed to write manifest of dump %s: %s", e.DumpPath, e.Err)
+}
+
+func (e *ManifestError) Cause() error  { return e.Err }
+func (e *ManifestError) Unwrap() error { return e.Err }
+
+// Return the error of the operation, which is the error of the context if the
+// operation failed because the context is done, as runc is then killed.
+func opError(ctx context.Context, op, id string, err error) error {
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return &Error{Op: op, ContainerId: id, Err: err}
+}
+
+// Return a context that is done once the timeout, in seconds, has passed. A
+// timeout of zero or less never passes.
+func withTimeout(
+	ctx context.Context,
+	seconds int,
+) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
+// Return a runc client. runc is killed if the runner dies, so that it does not
+// outlive the runner that is waiting for it.
+func newRunc() *_runc.Runc {
+	return &_runc.Runc{PdeathSignal: syscall.SIGKILL}
+}
+
 // Return the version numbers for runc
 func Version() (_runc.Version, error) {
-	r := &_runc.Runc{}
+	r := newRunc()
 	return r.Version(context.Background())
 }
 
-func Run(id, bundle string) (int, error) {
-	r := &_runc.Runc{}
+// Run the container and wait for it to exit, returning its exit status.
+// runc is killed if the context is done before the container exits.
+func Run(ctx context.Context, id, bundle string) (int, error) {
+	r := newRunc()
 	io, err := _runc.NewSTDIO()
 	if err != nil {
-		log.Error().Str("Error", err.Error()).Msg("Failed to create new STDIO")
+		return -1, &Error{Op: OpRun, ContainerId: id, Err: err}
 	}
 
 	log.Debug().Str("Bundle", bundle).Str("Id", id).Msg("Running container")
-	return r.Run(context.Background(), id, bundle, &_runc.CreateOpts{IO: io})
+	status, err := r.Run(ctx, id, bundle, &_runc.CreateOpts{IO: io})
+	if err != nil {
+		return status, opError(ctx, OpRun, id, err)
+	}
+	return status, nil
 }
 
 // PreDump the container, leaving it running.
-func PreDump(id, dumpPath, parentPath string) {
+// The dump only has a manifest if it succeeded. Returns a *ManifestError if
+// only writing the manifest failed, and an *Error otherwise.
+func PreDump(ctx context.Context, id, dumpPath, parentPath string) error {
 	log.Debug().
 		Str("ContainerId", id).
 		Str("DumpPath", dumpPath).
 		Str("ParentPath", parentPath).
 		Msg("Pre-dumping container")
 
-	r := &_runc.Runc{}
+	ctx, cancel := withTimeout(ctx, env.Getenv().PRE_DUMP_TIMEOUT)
+	defer cancel()
+	r := newRunc()
 	opts := _runc.CheckpointOpts{ImagePath: dumpPath, AllowTerminal: true}
 	if parentPath != "" {
 		opts.ParentPath = parentPath
 	}
-	err := r.Checkpoint(context.Background(), id, &opts, _runc.PreDump)
+	err := r.Checkpoint(ctx, id, &opts, _runc.PreDump)
 	if err != nil {
-		log.Error().Str("Error", err.Error()).Msg("Failed to pre-dump container")
+		return opError(ctx, OpPreDump, id, err)
 	}
+	if err := manifest.Write(dumpPath); err != nil {
+		return &ManifestError{DumpPath: dumpPath, Err: err}
+	}
+	return nil
 }
 
 // Dumps the entire container state.
-func Dump(id, dumpPath, parentPath string, leaveRunning bool) {
+// The dump only has a manifest if it succeeded. Returns a *ManifestError if
+// only writing the manifest failed, in which case the container has been
+// checkpointed, and an *Error otherwise.
+func Dump(
+	ctx context.Context,
+	id, dumpPath, parentPath string,
+	leaveRunning bool,
+) error {
 	log.Debug().
 		Str("ContainerId", id).
 		Str("DumpPath", dumpPath).
 		Str("ParentPath", parentPath).
 		Msg("Dumping container")
 
-	r := &_runc.Runc{}
+	ctx, cancel := withTimeout(ctx, env.Getenv().DUMP_TIMEOUT)
+	defer cancel()
+	r := newRunc()
 	opts := _runc.CheckpointOpts{
 		ImagePath:    dumpPath,
 		AllowOpenTCP: env.Getenv().CRIU_TCP_ESTABLISHED,
@@ -69,13 +174,22 @@ func Dump(id, dumpPath, parentPath string, leaveRunning bool) {
 		actions = []_runc.CheckpointAction{_runc.LeaveRunning}
 	}
 
-	err := r.Checkpoint(context.Background(), id, &opts, actions...)
+	err := r.Checkpoint(ctx, id, &opts, actions...)
 	if err != nil {
-		log.Error().Str("Error", err.Error()).Msg("Failed to dump container")
+		return opError(ctx, OpDump, id, err)
+	}
+	if err := manifest.Write(dumpPath); err != nil {
+		return &ManifestError{DumpPath: dumpPath, Err: err}
 	}
+	return nil
 }
 
-func Restore(id, dumpPath, bundle string) (int, error) {
+// Restore the container from the dump and wait for it to exit, returning its
+// exit status.
+// The restore is cancelled if the context is done, or the restore timeout
+// passes, before the container is running. Once running, the container runs
+// until it exits.
+func Restore(ctx context.Context, id, dumpPath, bundle string) (int, error) {
 	log.Debug().
 		Str("ContainerId", id).
 		Str("DumpPath", dumpPath).
@@ -84,10 +198,37 @@ func Restore(id, dumpPath, bundle string) (int, error) {
 
 	io, err := _runc.NewSTDIO()
 	if err != nil {
-		log.Error().Str("Error", err.Error()).Msg("Failed to create new STDIO")
+		return -1, &Error{Op: OpRestore, ContainerId: id, Err: err}
 	}
 
-	r := &_runc.Runc{}
+	r := newRunc()
+	restoreCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cancelled atomic.Value
+	go func() {
+		waitCtx, stop := withTimeout(ctx, env.Getenv().RESTORE_TIMEOUT)
+		defer stop()
+		for {
+			container, err := r.State(waitCtx, id)
+			if err == nil && container.Status == "running" {
+				return
+			}
+			select {
+			case <-restoreCtx.Done():
+				return
+			case <-waitCtx.Done():
+				log.Error().
+					Str("Error", waitCtx.Err().Error()).
+					Str("ContainerId", id).
+					Msg("Container not running in time, cancelling restore")
+				cancelled.Store(waitCtx.Err())
+				cancel()
+				return
+			case <-time.After(_STATE_POLL_INTERVAL):
+			}
+		}
+	}()
+
 	opts := &_runc.RestoreOpts{
 		IO: io,
 		CheckpointOpts: _runc.CheckpointOpts{
@@ -95,12 +236,63 @@ func Restore(id, dumpPath, bundle string) (int, error) {
 			AllowOpenTCP: env.Getenv().CRIU_TCP_ESTABLISHED,
 		},
 	}
-	return r.Restore(context.Background(), id, bundle, opts)
+	status, err := r.Restore(restoreCtx, id, bundle, opts)
+	if err != nil {
+		if reason, ok := cancelled.Load().(error); ok {
+			err = reason
+		}
+		return status, &Error{Op: OpRestore, ContainerId: id, Err: err}
+	}
+	return status, nil
 }
 
-func Kill(containerId string) error {
+// Wait for the container to be running, by polling its state until it is
+// running or the context is done.
+func WaitRunning(ctx context.Context, id string) error {
+	r := newRunc()
+	for {
+		container, err := r.State(ctx, id)
+		if err == nil && container.Status == "running" {
+			log.Debug().Str("ContainerId", id).Msg("Container is running")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "Container stopped before running")
+		case <-time.After(_STATE_POLL_INTERVAL):
+		}
+	}
+}
+
+func Kill(ctx context.Context, containerId string) error {
 	log.Debug().Str("ContainerId", containerId).Msg("Killing container")
 
-	r := &_runc.Runc{}
-	return r.Kill(context.Background(), containerId, int(syscall.SIGKILL), nil)
+	ctx, cancel := withTimeout(ctx, env.Getenv().KILL_TIMEOUT)
+	defer cancel()
+	r := newRunc()
+	err := r.Kill(ctx, containerId, int(syscall.SIGKILL), nil)
+	if err != nil {
+		return opError(ctx, OpKill, containerId, err)
+	}
+	return nil
+}
+
+// Thaw the container if it is paused, e.g. by a dump that was cancelled
+// before CRIU could resume it.
+func Thaw(ctx context.Context, containerId string) error {
+	ctx, cancel := withTimeout(ctx, env.Getenv().KILL_TIMEOUT)
+	defer cancel()
+	r := newRunc()
+	container, err := r.State(ctx, containerId)
+	if err != nil {
+		return opError(ctx, OpThaw, containerId, err)
+	}
+	if container.Status != "paused" {
+		return nil
+	}
+	log.Warn().Str("ContainerId", containerId).Msg("Thawing paused container")
+	if err := r.Resume(ctx, containerId); err != nil {
+		return opError(ctx, OpThaw, containerId, err)
+	}
+	return nil
 }
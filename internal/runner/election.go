@@ -0,0 +1,318 @@
+package runner
+
+import (
+	"math/rand"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+)
+
+// The prefix of the error returned by RPCs called with an epoch older than the
+// receiver's.
+const _STALE_EPOCH = "Stale epoch"
+
+// election holds the state used to elect a new source among the standbys when
+// the source is lost.
+//
+// Every election is held in a new epoch. A standby votes for at most one
+// candidate per epoch, and a candidate needs the votes of a majority of the
+// standbys to be elected. Sources from earlier epochs are fenced, i.e. their
+// pings are rejected, causing them to terminate their container.
+type election struct {
+	lock sync.Mutex
+	// The current epoch of the cluster.
+	epoch int
+	// The epoch in which the runner last voted, and the id of the candidate it
+	// voted for.
+	votedEpoch int
+	votedFor   string
+	// The standbys of the cluster, including this runner, as last advertised
+	// by the source.
+	peers []remote_target.RemoteTarget
+	// The time the last ping from the source was received.
+	lastPing time.Time
+}
+
+// Return the current epoch.
+func (e *election) Epoch() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.epoch
+}
+
+// Adopt the epoch if it is not older than the current one.
+// Returns an error if the epoch is stale.
+func (e *election) observe(epoch int) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if epoch < e.epoch {
+		return errors.Errorf("%s %d, current epoch is %d", _STALE_EPOCH, epoch, e.epoch)
+	}
+	e.epoch = epoch
+	return nil
+}
+
+// Return an error if the epoch is stale, without adopting it.
+func (e *election) check(epoch int) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if epoch < e.epoch {
+		return errors.Errorf("%s %d, current epoch is %d", _STALE_EPOCH, epoch, e.epoch)
+	}
+	return nil
+}
+
+// Return whether or not the error was caused by calling an RPC with a stale
+// epoch.
+func isStaleEpoch(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), _STALE_EPOCH)
+}
+
+// Return the number of the latest committed full dump in the directory, or -1
+// if there is none.
+func latestCommittedNr(dir dump.Dir) int {
+	dumps, err := dir.Recoverable()
+	if err != nil {
+		return -1
+	}
+	return dumps[0].Nr()
+}
+
+type RequestVoteArgs struct {
+	Epoch     int
+	Candidate remote_target.RemoteTarget
+	// The number of the latest full dump committed on the candidate.
+	LatestDump int
+}
+
+type RequestVoteReply struct {
+	Granted bool
+	Epoch   int
+}
+
+// Decide whether or not to vote for a candidate.
+//
+// The vote is granted if:
+// 1) this runner is a standby, i.e. its status is StandBy or Electing, as a
+// runner running the container, or still joining, must not elect another,
+// 2) the epoch is newer than any epoch this runner has voted in, or it has
+// already voted for the same candidate in the epoch,
+// 3) this runner has also not received a ping from the source within the ping
+// timeout, and
+// 4) the candidate has committed a dump at least as recent as this runner's
+// latest committed dump in dir.
+func (e *election) vote(
+	args *RequestVoteArgs,
+	reply *RequestVoteReply,
+	dir dump.Dir,
+	status runner_context.RunnerStatus,
+) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	id := args.Candidate.Id()
+	pingTimeout := time.Duration(env.Getenv().PING_TIMEOUT) * time.Second
+	switch {
+	case status != runner_context.StandBy && status != runner_context.Electing:
+		reply.Granted = false
+	case args.Epoch < e.epoch:
+		reply.Granted = false
+	case args.Epoch == e.votedEpoch && e.votedFor != id:
+		reply.Granted = false
+	case time.Since(e.lastPing) < pingTimeout:
+		reply.Granted = false
+	case args.LatestDump < latestCommittedNr(dir):
+		reply.Granted = false
+	default:
+		e.epoch = args.Epoch
+		e.votedEpoch = args.Epoch
+		e.votedFor = id
+		reply.Granted = true
+	}
+	reply.Epoch = e.epoch
+
+	log.Debug().
+		Str("Candidate", id).
+		Int("Epoch", args.Epoch).
+		Bool("Granted", reply.Granted).
+		Msg("Vote requested")
+}
+
+// Return the delay before this runner should stand as a candidate.
+//
+// Standbys are ranked by id, and each rank waits one more ping interval, with
+// some jitter, so that elections are rarely split.
+func (e *election) candidateDelay(self remote_target.RemoteTarget) time.Duration {
+	e.lock.Lock()
+	ids := []string{}
+	for _, peer := range e.peers {
+		ids = append(ids, peer.Id())
+	}
+	e.lock.Unlock()
+	sort.Strings(ids)
+
+	rank := sort.SearchStrings(ids, self.Id())
+	interval := time.Duration(env.Getenv().PING_INTERVAL) * time.Second
+	jitter := time.Duration(rand.Int63n(int64(interval/2) + 1))
+	return time.Duration(rank)*interval + jitter
+}
+
+// Try to get elected as the new source.
+// Returns whether or not a majority of the standbys voted for this runner, and
+// the epoch of the election.
+func (runner *Runner) standForElection() (bool, int) {
+	self := runner.ToTarget()
+	latest := latestCommittedNr(runner.DumpDir)
+
+	e := &runner.election
+	e.lock.Lock()
+	if e.votedEpoch > e.epoch {
+		e.epoch = e.votedEpoch
+	}
+	e.epoch++
+	epoch := e.epoch
+	e.votedEpoch = epoch
+	e.votedFor = self.Id()
+	peers := append([]remote_target.RemoteTarget{}, e.peers...)
+	e.lock.Unlock()
+
+	votes := 1 // Vote for self
+	quorum := 1
+	if len(peers) > 0 {
+		quorum = len(peers)/2 + 1
+	}
+	log.Info().
+		Int("Epoch", epoch).
+		Int("Quorum", quorum).
+		Int("LatestDump", latest).
+		Msg("Standing for election")
+
+	for _, peer := range peers {
+		if peer.Id() == self.Id() {
+			continue
+		}
+		var reply RequestVoteReply
+		args := RequestVoteArgs{Epoch: epoch, Candidate: self, LatestDump: latest}
+		if err := callWithTimeout(&peer, "RPC.RequestVote", args, &reply); err != nil {
+			log.Warn().
+				Str("Error", err.Error()).
+				Str("Peer", peer.Id()).
+				Msg("Failed to request vote")
+			continue
+		}
+		if reply.Epoch > epoch {
+			log.Info().
+				Int("Epoch", reply.Epoch).
+				Str("Peer", peer.Id()).
+				Msg("Peer is in a newer epoch, abandoning election")
+			e.observe(reply.Epoch)
+			return false, reply.Epoch
+		}
+		if reply.Granted {
+			votes++
+		}
+	}
+
+	log.Info().
+		Int("Epoch", epoch).
+		Int("Votes", votes).
+		Int("Quorum", quorum).
+		Msg("Election finished")
+	return votes >= quorum, epoch
+}
+
+func (runner *Runner) loopElecting() {
+	delay := runner.election.candidateDelay(runner.ToTarget())
+	log.Debug().Str("Delay", delay.String()).Msg("Waiting to stand for election")
+	time.Sleep(delay)
+	if runner.Status() != runner_context.Electing {
+		// Another standby was elected while waiting
+		return
+	}
+
+	elected, epoch := runner.standForElection()
+	var peers []remote_target.RemoteTarget
+	runner.WithLock(func() {
+		if runner.Status() != runner_context.Electing {
+			// Another standby was elected while standing for election
+			return
+		}
+		if !elected || runner.election.Epoch() != epoch {
+			// Wait for the elected standby to announce itself, or for another
+			// ping timeout to stand for election again.
+			runner.SetStatusNoLock(runner_context.StandBy)
+			return
+		}
+
+		log.Info().Int("Epoch", epoch).Msg("Elected as new source")
+		// Replicate to the other standbys, which are told to follow this runner
+		// below.
+		self := runner.ToTarget()
+		runner.election.lock.Lock()
+		for _, peer := range runner.election.peers {
+			if peer.Id() != self.Id() {
+				runner.AddTarget(peer)
+				peers = append(peers, peer)
+			}
+		}
+		runner.election.lock.Unlock()
+		runner.SetStatusNoLock(runner_context.Recovery)
+	})
+	if len(peers) > 0 {
+		runner.announceSource(peers, epoch, runner.ToTarget())
+	}
+}
+
+// Call an RPC on a target, giving up after the source ping timeout.
+func callWithTimeout(
+	target *remote_target.RemoteTarget,
+	method string,
+	args interface{},
+	reply interface{},
+) error {
+	client, err := target.Dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return callClientWithTimeout(
+		client,
+		method,
+		args,
+		reply,
+		time.Duration(env.Getenv().PING_TIMEOUT_SOURCE)*time.Second,
+	)
+}
+
+// Call an RPC on a client, giving up after the timeout. A timeout of zero or
+// less never passes.
+func callClientWithTimeout(
+	client *rpc.Client,
+	method string,
+	args interface{},
+	reply interface{},
+	timeout time.Duration,
+) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	if timeout <= 0 {
+		<-call.Done
+		return call.Error
+	}
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return errors.Errorf("%s timed out", method)
+	}
+}
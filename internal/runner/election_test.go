@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+)
+
+func TestVote(t *testing.T) {
+	candidate := remote_target.RemoteTarget{Host: "10.0.0.2", RPCPort: 1234}
+	other := remote_target.RemoteTarget{Host: "10.0.0.3", RPCPort: 1234}
+	tests := []struct {
+		name     string
+		election *election
+		status   runner_context.RunnerStatus
+		args     RequestVoteArgs
+		granted  bool
+	}{
+		{"granted", &election{epoch: 1}, runner_context.StandBy,
+			RequestVoteArgs{Epoch: 2, Candidate: candidate}, true},
+		{"granted while electing", &election{epoch: 1}, runner_context.Electing,
+			RequestVoteArgs{Epoch: 2, Candidate: candidate}, true},
+		{"running", &election{epoch: 1}, runner_context.Running,
+			RequestVoteArgs{Epoch: 2, Candidate: candidate}, false},
+		{"joining", &election{epoch: 1}, runner_context.Joining,
+			RequestVoteArgs{Epoch: 2, Candidate: candidate}, false},
+		{"stale epoch", &election{epoch: 3}, runner_context.StandBy,
+			RequestVoteArgs{Epoch: 2, Candidate: candidate}, false},
+		{"voted for other", &election{epoch: 2, votedEpoch: 2, votedFor: other.Id()},
+			runner_context.StandBy,
+			RequestVoteArgs{Epoch: 2, Candidate: candidate}, false},
+		{"voted for same", &election{epoch: 2, votedEpoch: 2, votedFor: candidate.Id()},
+			runner_context.StandBy,
+			RequestVoteArgs{Epoch: 2, Candidate: candidate}, true},
+		{"source alive", &election{epoch: 1, lastPing: time.Now()}, runner_context.StandBy,
+			RequestVoteArgs{Epoch: 2, Candidate: candidate}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply RequestVoteReply
+			tt.election.vote(&tt.args, &reply, dump.Dir(t.TempDir()), tt.status)
+			if reply.Granted != tt.granted {
+				t.Fatalf("vote() granted %t, want %t", reply.Granted, tt.granted)
+			}
+		})
+	}
+}
+
+func TestVoteOutdatedCandidate(t *testing.T) {
+	dir := dump.Dir(t.TempDir())
+	for _, name := range []string{"d3", "d7"} {
+		d := dir.FromString(name)
+		if err := os.MkdirAll(d.Path(), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	candidate := remote_target.RemoteTarget{Host: "10.0.0.2", RPCPort: 1234}
+	tests := []struct {
+		latest  int
+		granted bool
+	}{
+		{3, false},
+		{7, true},
+		{11, true},
+	}
+	for _, tt := range tests {
+		var e election
+		var reply RequestVoteReply
+		args := RequestVoteArgs{Epoch: 1, Candidate: candidate, LatestDump: tt.latest}
+		e.vote(&args, &reply, dir, runner_context.StandBy)
+		if reply.Granted != tt.granted {
+			t.Fatalf("vote() for dump %d granted %t, want %t", tt.latest, reply.Granted, tt.granted)
+		}
+	}
+}
@@ -0,0 +1,554 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+	"github.com/Xarepo/msc-container-migration/internal/runc"
+	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+)
+
+// preCopyRound describes a single pre-dump, and its sync, taken while
+// migrating.
+type preCopyRound struct {
+	nr   int
+	dump *dump.Dump
+	// The size, in bytes, of the pre-dump, i.e. the memory changed since the
+	// previous dump.
+	size               int64
+	dumpTime, syncTime time.Duration
+	// Whether or not the size of the pre-dump is known and the pre-dump was
+	// synced to the destination. A round that was not measured never converges,
+	// and is left out of downtime estimates.
+	measured bool
+}
+
+// Migrate the container to the migration target.
+//
+// The lock is only held while dumping the container and while changing the
+// state of the runner, not while syncing the dumps or calling the destination,
+// and the targets are pinged throughout, so that the standbys do not elect a
+// new source while the container is being migrated.
+func (runner *Runner) loopMigrating() {
+	pinger := runner.startPinging()
+	defer pinger.stop()
+
+	var destination remote_target.RemoteTarget
+	var nextDump *dump.Dump
+	var parentPath string
+	ok := true
+	runner.WithLock(func() {
+		log.Debug().
+			Str("ContainerId", runner.ContainerId).
+			Str("Destination", runner.MigrationTarget).
+			Msg("Migrating container")
+
+		// The destination may have been removed since the migration was requested
+		target := runner.GetTarget(runner.MigrationTarget)
+		if target == nil {
+			runner.abortMigration(errors.Errorf(
+				"Migration destination %s is no longer a target",
+				runner.MigrationTarget,
+			))
+			ok = false
+			return
+		}
+		destination = *target
+
+		// Pre-dump
+		nextDump = runner.DumpDir.FirstDump()
+		parentPath = ""
+		if runner.Chain.Latest() != nil {
+			nextDump = runner.Chain.Latest().Dump().NextPreDump()
+			parentPath = runner.Chain.Latest().Dump().ParentPath()
+		}
+		// If the current chain is empty but the previous one is not when
+		// migrating, rather than creating the first dump in the current chain, the
+		// next dump should be linked to the previous chain as this will be more
+		// effective. This is equivalent to setting the current chain to the
+		// previous chain.
+		if runner.Chain.Latest() == nil &&
+			runner.PrevChain != nil && runner.PrevChain.Latest() != nil {
+			runner.Chain = runner.PrevChain
+			runner.PrevChain = nil
+			nextDump = runner.Chain.Latest().Dump().NextPreDump()
+			parentPath = runner.Chain.Latest().Dump().ParentPath()
+		}
+	})
+	if !ok {
+		return
+	}
+	rounds, ok, err := runner.preCopy(&destination, nextDump, parentPath)
+	if err != nil {
+		runner.WithLock(func() { runner.abortMigration(err) })
+		return
+	}
+	if !ok {
+		runner.WithLock(func() {
+			runner.abortMigration(errors.Errorf(
+				"Migration did not fit within the downtime budget of %s",
+				runner.MigrationMaxDowntime,
+			))
+		})
+		return
+	}
+
+	// Dump
+	lastPreDump := rounds[len(rounds)-1].dump
+	nextDump = lastPreDump.NextFullDump()
+	var dumpTime time.Duration
+	runner.WithLock(func() {
+		atomic.StoreInt32(&runner.frozen, 1)
+		start := time.Now()
+		err = runc.Dump(
+			runner.RuncContext(),
+			runner.ContainerId,
+			nextDump.Path(),
+			lastPreDump.ParentPath(),
+			false)
+		dumpTime = time.Since(start)
+		var manifestErr *runc.ManifestError
+		if errors.As(err, &manifestErr) {
+			// The container has been checkpointed, and may only be restored from
+			// the dump.
+			runner.rollbackMigration(nextDump, err)
+			return
+		}
+		if err != nil {
+			os.RemoveAll(nextDump.Path())
+			runner.abortFinalDump(err)
+			return
+		}
+		runner.Chain.Push(*nextDump)
+	})
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	if err := runner.syncTarget(&destination); err != nil {
+		runner.WithLock(func() { runner.rollbackMigration(nextDump, err) })
+		return
+	}
+	log.Info().
+		Str("Dump", nextDump.Base()).
+		Str("DumpTime", dumpTime.String()).
+		Str("SyncTime", time.Since(start).String()).
+		Msg("Final dump synced")
+
+	client, err := destination.Dial()
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Failed to dial RPC")
+		runner.WithLock(func() {
+			runner.rollbackMigration(
+				nextDump,
+				errors.Wrap(err, "Failed to dial RPC"),
+			)
+		})
+		return
+	}
+	defer client.Close()
+
+	// The migration is a handover of the container, so it is done in a new
+	// epoch to fence this runner.
+	epoch := runner.election.Epoch() + 1
+	others := []remote_target.RemoteTarget{}
+	var dumpNames []string
+	runner.WithLock(func() {
+		for _, target := range runner.Targets {
+			if target.Id() != destination.Id() {
+				others = append(others, target)
+			}
+		}
+		dumpNames = runner.Chain.GetNames()
+	})
+
+	// Prepare: make sure the destination has the complete chain
+	var reply struct{}
+	prepareArgs := PrepareMigrationArgs{
+		DumpNames:   dumpNames,
+		ContainerId: runner.ContainerId,
+	}
+	err = callClientWithTimeout(
+		client,
+		"RPC.PrepareMigration",
+		prepareArgs,
+		&reply,
+		time.Duration(env.Getenv().PING_TIMEOUT_SOURCE)*time.Second,
+	)
+	if err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Msg("Destination failed to prepare migration")
+		runner.WithLock(func() {
+			runner.rollbackMigration(
+				nextDump,
+				errors.Wrap(err, "Destination failed to prepare migration"),
+			)
+		})
+		return
+	}
+
+	// Commit: the call returns once the destination has restored the
+	// container and confirmed it running, or failed to do so. The destination
+	// gives up on the restore after the restore timeout, so the call is given
+	// up on, and the migration rolled back, shortly after. Should the
+	// destination restore the container anyway, it fences this runner with
+	// the epoch of the migration.
+	// The destination is no longer pinged, as it takes over in the new epoch
+	// once restored, and would fence this runner for pinging in the old one.
+	pinger.skip(destination.Id())
+	args := MigrateArgs{
+		DumpNames:   dumpNames,
+		ContainerId: runner.ContainerId,
+		BundlePath:  runner.BundlePath,
+		Epoch:       epoch,
+		Targets:     others,
+	}
+	err = callClientWithTimeout(
+		client,
+		"RPC.Migrate",
+		args,
+		&reply,
+		migrateTimeout(),
+	)
+	if err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Msg("Destination failed to restore container")
+		runner.WithLock(func() {
+			runner.rollbackMigration(
+				nextDump,
+				errors.Wrap(err, "Destination failed to restore container"),
+			)
+		})
+		return
+	}
+	log.Info().
+		Str("Destination", destination.Id()).
+		Msg("Destination confirmed container running")
+	// The pings must stop before the targets follow the destination, which
+	// would fence this runner for pinging in the old epoch.
+	pinger.stop()
+	runner.election.observe(epoch)
+	runner.announceSource(others, epoch, destination)
+
+	runner.WithLock(func() {
+		runner.MigrationError = nil
+		runner.SetStatusNoLock(runner_context.Stopped)
+		runner.migrated <- true
+	})
+}
+
+// pinger pings the targets of a runner in the background, e.g. while
+// migrating, during which the runner's loop does not.
+type pinger struct {
+	// The id of the target not to ping, if any.
+	exclude  atomic.Value
+	stopping chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+// Ping the targets every ping interval until stopped.
+func (runner *Runner) startPinging() *pinger {
+	p := &pinger{stopping: make(chan struct{}), stopped: make(chan struct{})}
+	p.exclude.Store("")
+	go func() {
+		defer close(p.stopped)
+		pingTick := time.NewTicker(
+			time.Duration(env.Getenv().PING_INTERVAL) * time.Second,
+		)
+		defer pingTick.Stop()
+		for {
+			select {
+			case <-pingTick.C:
+				runner.pingTargets(p.exclude.Load().(string))
+			case <-p.stopping:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Stop pinging the target with the given id.
+func (p *pinger) skip(id string) {
+	p.exclude.Store(id)
+}
+
+// Stop pinging, and wait for any pings in progress to finish. May be called
+// more than once.
+func (p *pinger) stop() {
+	p.once.Do(func() { close(p.stopping) })
+	<-p.stopped
+}
+
+// Return how long to wait for the destination to restore the container when
+// committing a migration, i.e. the restore timeout and the source ping timeout
+// to allow for the round trip. Zero, i.e. no timeout, if the restore timeout
+// is disabled.
+func migrateTimeout() time.Duration {
+	if env.Getenv().RESTORE_TIMEOUT <= 0 {
+		return 0
+	}
+	return time.Duration(
+		env.Getenv().RESTORE_TIMEOUT+env.Getenv().PING_TIMEOUT_SOURCE,
+	) * time.Second
+}
+
+// Abort a migration before the container has been frozen, leaving the
+// container running.
+// Should be called while holding the lock.
+func (runner *Runner) abortMigration(err error) {
+	log.Error().
+		Str("Error", err.Error()).
+		Str("Destination", runner.MigrationTarget).
+		Msg("Migration aborted")
+	runner.MigrationTarget = ""
+	runner.MigrationMaxDowntime = 0
+	runner.MigrationError = err
+	runner.SetStatusNoLock(runner_context.Running)
+}
+
+// Abort a migration whose final dump failed.
+//
+// The container is left running by a failed dump, unless it was killed anyway,
+// in which case its exit is reported, as there is no dump to restore it from.
+// A dump that was cancelled, or timed out, may leave the container frozen, in
+// which case it is thawed.
+// Should be called while holding the lock.
+func (runner *Runner) abortFinalDump(err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		if err := runc.Thaw(context.Background(), runner.ContainerId); err != nil {
+			log.Error().
+				Str("Error", err.Error()).
+				Msg("Failed to thaw container after failed final dump")
+		}
+	}
+	exited := !atomic.CompareAndSwapInt32(&runner.frozen, 1, 0)
+	runner.abortMigration(err)
+	if exited {
+		log.Error().Msg("Container exited during failed final dump")
+		runner.migrated <- true
+	}
+}
+
+// Abort a migration after the container has been frozen by the final dump,
+// by restoring the container locally from the final dump and resuming
+// replication to the targets.
+// Should be called while holding the lock.
+func (runner *Runner) rollbackMigration(finalDump *dump.Dump, err error) {
+	log.Warn().
+		Str("Destination", runner.MigrationTarget).
+		Str("Dump", finalDump.Base()).
+		Msg("Migration aborted, rolling back")
+
+	runner.MigrationTarget = ""
+	runner.MigrationMaxDowntime = 0
+	runner.MigrationError = err
+	// Let the goroutine of the frozen container return without reporting the
+	// container as exited, before restoring the container.
+	runner.migrated <- false
+	if err := runner.startRestore(finalDump.Path()); err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Msg("Failed to restore container locally")
+		runner.SetStatusNoLock(runner_context.Failed)
+		return
+	}
+	runner.NewChain()
+	runner.SetStatusNoLock(runner_context.Running)
+	log.Info().Str("Dump", finalDump.Base()).Msg("Container restored locally")
+}
+
+// Iteratively pre-dump the container and sync the pre-dumps to the
+// destination, until the pre-dumps have converged, i.e. the memory changed
+// between two rounds is small enough, or the maximum number of rounds has been
+// reached.
+//
+// If the migration has a downtime budget, the pre-dumps have instead converged
+// once the estimated downtime fits the budget. If it never does, the
+// migration should be aborted.
+//
+// Returns the rounds taken, of which there is always at least one, and whether
+// or not the container may be frozen for the final dump. Fails if a pre-dump
+// fails.
+// Should be called without holding the lock, which is taken for each pre-dump.
+func (runner *Runner) preCopy(
+	destination *remote_target.RemoteTarget,
+	firstDump *dump.Dump,
+	parentPath string,
+) ([]preCopyRound, bool, error) {
+	budget := runner.MigrationMaxDowntime
+	rounds := []preCopyRound{}
+	nextDump := firstDump
+	for {
+		round, err := runner.preCopyRound(destination, nextDump, parentPath)
+		if err != nil {
+			return nil, false, err
+		}
+		round.nr = len(rounds) + 1
+		rounds = append(rounds, round)
+		log.Info().
+			Int("Round", round.nr).
+			Str("Dump", round.dump.Base()).
+			Int64("Size", round.size).
+			Str("DumpTime", round.dumpTime.String()).
+			Str("SyncTime", round.syncTime.String()).
+			Msg("Pre-copy round finished")
+
+		if budget > 0 {
+			estimate, ok := estimateDowntime(rounds)
+			if !ok {
+				log.Warn().
+					Int("Round", round.nr).
+					Msg("Downtime could not be estimated")
+			} else {
+				log.Info().
+					Str("Estimate", estimate.String()).
+					Str("Budget", budget.String()).
+					Msg("Downtime estimated")
+				if estimate <= budget {
+					return rounds, true, nil
+				}
+			}
+		} else if converged(rounds) {
+			return rounds, true, nil
+		}
+		if len(rounds) >= env.Getenv().MIGRATION_MAX_ROUNDS {
+			log.Warn().
+				Int("Rounds", len(rounds)).
+				Msg("Pre-copy did not converge, reached maximum number of rounds")
+			return rounds, budget == 0, nil
+		}
+		parentPath = nextDump.ParentPath()
+		nextDump = nextDump.NextPreDump()
+	}
+}
+
+// Pre-dump the container and sync the pre-dump to the destination.
+// Fails if the pre-dump fails, in which case it is not pushed onto the chain.
+// A failed sync leaves the pre-dump unsynced, to be synced with the next round,
+// and the round unmeasured.
+// Should be called without holding the lock, which is only taken to pre-dump.
+func (runner *Runner) preCopyRound(
+	destination *remote_target.RemoteTarget,
+	d *dump.Dump,
+	parentPath string,
+) (preCopyRound, error) {
+	var err error
+	var dumpTime time.Duration
+	runner.WithLock(func() {
+		start := time.Now()
+		err = runc.PreDump(
+			runner.RuncContext(),
+			runner.ContainerId,
+			d.Path(),
+			parentPath,
+		)
+		if err != nil {
+			os.RemoveAll(d.Path())
+			return
+		}
+		dumpTime = time.Since(start)
+		runner.Chain.Push(*d)
+	})
+	if err != nil {
+		return preCopyRound{}, err
+	}
+
+	measured := true
+	size, err := d.Size()
+	if err != nil {
+		log.Warn().
+			Str("Error", err.Error()).
+			Str("Dump", d.Base()).
+			Msg("Failed to determine size of pre-dump")
+		measured = false
+	}
+
+	start := time.Now()
+	if err := runner.syncTarget(destination); err != nil {
+		log.Warn().
+			Str("Error", err.Error()).
+			Str("Dump", d.Base()).
+			Msg("Failed to sync pre-dump")
+		measured = false
+	}
+	return preCopyRound{
+		dump:     d,
+		size:     size,
+		dumpTime: dumpTime,
+		syncTime: time.Since(start),
+		measured: measured,
+	}, nil
+}
+
+// Return whether or not the pre-copy has converged, i.e. the latest round was
+// smaller than the configured delta size or, compared to the first round, the
+// configured delta ratio. Never converges on a round that was not measured.
+func converged(rounds []preCopyRound) bool {
+	latest := rounds[len(rounds)-1]
+	if !latest.measured {
+		return false
+	}
+	if latest.size <= int64(env.Getenv().MIGRATION_DELTA_SIZE) {
+		log.Debug().Int64("Size", latest.size).Msg("Pre-copy converged on size")
+		return true
+	}
+	if len(rounds) > 1 && rounds[0].measured && rounds[0].size > 0 {
+		ratio := float64(latest.size) / float64(rounds[0].size)
+		if ratio <= env.Getenv().MIGRATION_DELTA_RATIO {
+			log.Debug().Float64("Ratio", ratio).Msg("Pre-copy converged on ratio")
+			return true
+		}
+	}
+	return false
+}
+
+// Estimate the downtime of the migration if the container was frozen after
+// the latest round.
+//
+// The final dump is assumed to be about as large as the latest pre-dump, as
+// the memory is dirtied at about the same rate between rounds. The time to dump
+// and transfer it is estimated from the dump rate and link throughput measured
+// over all measured rounds. The time to restore the container on the
+// destination is not included.
+//
+// Returns false if the downtime can not be estimated, i.e. the latest round was
+// not measured.
+func estimateDowntime(rounds []preCopyRound) (time.Duration, bool) {
+	latest := rounds[len(rounds)-1]
+	if !latest.measured {
+		return 0, false
+	}
+	var size int64
+	var dumpTime, syncTime time.Duration
+	for _, round := range rounds {
+		if !round.measured {
+			continue
+		}
+		size += round.size
+		dumpTime += round.dumpTime
+		syncTime += round.syncTime
+	}
+	if size == 0 {
+		return 0, true
+	}
+	log.Debug().
+		Float64("DumpRate", float64(size)/dumpTime.Seconds()).
+		Float64("Throughput", float64(size)/syncTime.Seconds()).
+		Msg("Measured rates in bytes per second")
+
+	perByte := float64(dumpTime+syncTime) / float64(size)
+	return time.Duration(perByte * float64(latest.size)), true
+}
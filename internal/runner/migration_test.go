@@ -0,0 +1,131 @@
+package runner
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+)
+
+const _MiB = 1 << 20
+
+func TestConverged(t *testing.T) {
+	tests := []struct {
+		name   string
+		rounds []preCopyRound
+		want   bool
+	}{
+		{"small", []preCopyRound{
+			{size: _MiB / 2, measured: true},
+		}, true},
+		{"large", []preCopyRound{
+			{size: 100 * _MiB, measured: true},
+		}, false},
+		{"ratio", []preCopyRound{
+			{size: 100 * _MiB, measured: true},
+			{size: 5 * _MiB, measured: true},
+		}, true},
+		{"ratio above delta", []preCopyRound{
+			{size: 100 * _MiB, measured: true},
+			{size: 50 * _MiB, measured: true},
+		}, false},
+		{"unknown size", []preCopyRound{
+			{size: 0, measured: false},
+		}, false},
+		{"failed sync", []preCopyRound{
+			{size: 100 * _MiB, measured: true},
+			{size: 5 * _MiB, measured: false},
+		}, false},
+		{"unmeasured first round", []preCopyRound{
+			{size: 0, measured: false},
+			{size: 5 * _MiB, measured: true},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := converged(tt.rounds); got != tt.want {
+				t.Fatalf("converged() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateDowntime(t *testing.T) {
+	tests := []struct {
+		name     string
+		rounds   []preCopyRound
+		want     time.Duration
+		estimate bool
+	}{
+		{"single round", []preCopyRound{
+			{size: 10 * _MiB, dumpTime: time.Second, syncTime: time.Second, measured: true},
+		}, 2 * time.Second, true},
+		{"scaled to latest", []preCopyRound{
+			{size: 30 * _MiB, dumpTime: 2 * time.Second, syncTime: time.Second, measured: true},
+			{size: 10 * _MiB, dumpTime: time.Second, syncTime: 2 * time.Second, measured: true},
+		}, 1500 * time.Millisecond, true},
+		{"unmeasured rounds left out", []preCopyRound{
+			{size: 10 * _MiB, dumpTime: time.Second, syncTime: time.Second, measured: true},
+			{size: 0, dumpTime: time.Hour, syncTime: time.Hour, measured: false},
+			{size: 10 * _MiB, dumpTime: time.Second, syncTime: time.Second, measured: true},
+		}, 2 * time.Second, true},
+		{"latest unmeasured", []preCopyRound{
+			{size: 10 * _MiB, dumpTime: time.Second, syncTime: time.Second, measured: true},
+			{size: 0, dumpTime: time.Second, syncTime: time.Second, measured: false},
+		}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := estimateDowntime(tt.rounds)
+			if ok != tt.estimate || got != tt.want {
+				t.Fatalf("estimateDowntime() = %s, %t, want %s, %t", got, ok, tt.want, tt.estimate)
+			}
+		})
+	}
+}
+
+// Serve the RPC handler of a standby, and return it as a target.
+func serveStandby(t *testing.T) (*Runner, remote_target.RemoteTarget) {
+	standby := New("counter", ".")
+	mux := http.NewServeMux()
+	mux.Handle(remote_target.RPCPath(""), standby.rpcServer)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := remote_target.RemoteTarget{Host: host}
+	if target.RPCPort, err = strconv.Atoi(port); err != nil {
+		t.Fatal(err)
+	}
+	return standby, target
+}
+
+// The standbys are pinged while migrating, except for a skipped destination.
+func TestPinger(t *testing.T) {
+	standby, target := serveStandby(t)
+	destination, destinationTarget := serveStandby(t)
+	source := New("counter", ".")
+	source.Targets = []remote_target.RemoteTarget{target, destinationTarget}
+
+	pinger := source.startPinging()
+	pinger.skip(destinationTarget.Id())
+	time.Sleep(1500 * time.Millisecond)
+	pinger.stop()
+	pinger.stop()
+
+	if standby.SourceLastPing().IsZero() {
+		t.Error("Standby was not pinged")
+	}
+	if !destination.SourceLastPing().IsZero() {
+		t.Error("Skipped destination was pinged")
+	}
+	if len(source.Targets) != 2 {
+		t.Errorf("Targets = %v, want both", source.Targets)
+	}
+}
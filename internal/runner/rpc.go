@@ -4,12 +4,19 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 
+	"github.com/Xarepo/msc-container-migration/internal/chain"
+	"github.com/Xarepo/msc-container-migration/internal/chunk"
+	"github.com/Xarepo/msc-container-migration/internal/codec"
 	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/env"
 	"github.com/Xarepo/msc-container-migration/internal/remote_target"
 	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+	"github.com/Xarepo/msc-container-migration/internal/transport"
 )
 
 // RPCHandler is a struct encapsulating all RPCs. This makes sure only RPC
@@ -27,51 +34,353 @@ func (handler *RPCHandler) Join(
 		Str("Host", target.Host).
 		Int("RPCPort", target.RPCPort).
 		Int("FileTransferPort", target.FileTransferPort).
+		Str("HostKey", target.HostKey).
 		Msg("Executing JOIN RPC")
 
+	// Refuse targets that dumps cannot be transferred to, rather than failing
+	// every sync to them.
+	if err := transport.CheckTarget(target); err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Str("Target", target.Id()).
+			Str("Transport", target.Transport).
+			Msg("Refusing joining target")
+		return err
+	}
+
+	target.Codec = codec.Negotiate(env.Getenv().COMPRESSION, target.Codecs)
+	log.Debug().
+		Str("Target", target.Id()).
+		Str("Codec", target.Codec).
+		Msg("Codec agreed with joining target")
 	handler.runner.AddTarget(*target)
 	*reply = handler.runner.ContainerId
 
-	// Transfer chains
+	// Transfer chains. If any chain fails to transfer, or to be committed, the
+	// join fails and the target is removed, as the joiner gives up on joining.
+	var err error
 	handler.runner.WithLock(func() {
-		if handler.runner.PrevChain != nil {
-			handler.runner.PrevChain.FullTransfer(target)
+		chains := []*chain.DumpChain{handler.runner.PrevChain, handler.runner.Chain}
+		for _, c := range chains {
+			if c == nil || c.Latest() == nil {
+				continue
+			}
+			err = c.FullTransfer(target)
+			if err == nil {
+				err = handler.runner.commitDump(target, c.Latest().Dump())
+			}
+			if err != nil {
+				log.Error().
+					Str("Error", err.Error()).
+					Str("Target", target.Id()).
+					Msg("Failed to transfer chain to joining target")
+				// The target may join again under the same id, in which case the
+				// chains must be transferred again.
+				for _, c := range chains {
+					if c != nil {
+						c.Unsync(target)
+					}
+				}
+				handler.runner.RemoveTarget(*target)
+				return
+			}
 		}
-		handler.runner.Chain.FullTransfer(target)
 	})
 
+	return err
+}
+
+// Reply with the id of the container of the cluster. Called by runners before
+// joining, as they keep the dumps transferred while joining in the directory of
+// the container.
+func (handler *RPCHandler) Container(args *struct{}, reply *string) error {
+	log.Trace().Msg("Executing CONTAINER RPC")
+	*reply = handler.runner.ContainerId
 	return nil
 }
 
-func (handler *RPCHandler) Ping(args struct{}, reply *bool) error {
-	log.Trace().Msg("PING received")
-	handler.runner.PingInterrupt <- true
+type PingArgs struct {
+	// The epoch of the source.
+	Epoch int
+	// The RPC address of the source.
+	Source string
+	// The targets of the source, i.e. all standbys of the cluster.
+	Targets []remote_target.RemoteTarget
+}
+
+// Receive a ping from the source.
+// Pings from sources of earlier epochs are rejected, fencing the source.
+func (handler *RPCHandler) Ping(args *PingArgs, reply *bool) error {
+	log.Trace().Int("Epoch", args.Epoch).Msg("PING received")
+	e := &handler.runner.election
+	if err := e.observe(args.Epoch); err != nil {
+		log.Warn().Str("Error", err.Error()).Msg("Rejecting ping from stale source")
+		return err
+	}
+	e.lock.Lock()
+	e.peers = args.Targets
+	e.lastPing = time.Now()
+	e.lock.Unlock()
+	handler.runner.SetSourcePing(args.Source)
+
+	select {
+	case handler.runner.PingInterrupt <- true:
+	default:
+	}
 	*reply = true
 	return nil
 }
 
+// Vote in an election of a new source.
+func (handler *RPCHandler) RequestVote(
+	args *RequestVoteArgs,
+	reply *RequestVoteReply,
+) error {
+	handler.runner.election.vote(
+		args,
+		reply,
+		handler.runner.DumpDir,
+		handler.runner.Status(),
+	)
+	return nil
+}
+
+type FollowArgs struct {
+	Epoch int
+	// The RPC address of the new source.
+	Source string
+}
+
+// Follow a new source, that took over the container in the given epoch, either
+// by being elected or by having the container migrated to it.
+// The new source already replicates to this runner, so it only needs to
+// listen to the new source's pings.
+func (handler *RPCHandler) Follow(args *FollowArgs, reply *struct{}) error {
+	log.Info().
+		Int("Epoch", args.Epoch).
+		Str("Source", args.Source).
+		Msg("Following new source")
+	e := &handler.runner.election
+	if err := e.observe(args.Epoch); err != nil {
+		return err
+	}
+	e.lock.Lock()
+	e.lastPing = time.Now()
+	e.lock.Unlock()
+
+	handler.runner.WithLock(func() {
+		handler.runner.Source = args.Source
+		if handler.runner.Status() == runner_context.Electing {
+			handler.runner.SetStatusNoLock(runner_context.StandBy)
+		}
+	})
+	select {
+	case handler.runner.PingInterrupt <- true:
+	default:
+	}
+	return nil
+}
+
+type CommitArgs struct {
+	ContainerId, DumpName string
+}
+
+// Commit a dump that has been completely transferred to this node, making it
+// possible to recover from. The dump, and the rest of its chain, is verified
+// against its manifest before being committed. Replies with the name of the
+// committed dump as an acknowledgement.
+//
+// Does not take the runner's lock, as commits are sent while joining, during
+// which the joining runner holds its lock while waiting for the JOIN RPC to
+// return.
+func (handler *RPCHandler) Commit(args *CommitArgs, reply *string) error {
+	log.Trace().
+		Str("ContainerId", args.ContainerId).
+		Str("Dump", args.DumpName).
+		Msg("Executing COMMIT RPC")
+
+	if !dump.IsDumpName(args.DumpName) {
+		return errors.Errorf("Invalid dump name %s", args.DumpName)
+	}
+	// Verify the dump, and the rest of its chain, before committing it.
+	d := handler.runner.DumpDir.FromString(args.DumpName)
+	if _, err := chain.ReconstructChain(d.Path()); err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Str("Dump", args.DumpName).
+			Msg("Refusing to commit corrupt dump")
+		return err
+	}
+	if err := d.Commit(); err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Str("Dump", args.DumpName).
+			Msg("Failed to commit dump")
+		return err
+	}
+	*reply = args.DumpName
+	return nil
+}
+
+// Reply with the chunks, of the given ones, that are not in the dumps of this
+// runner, so that the sender only transfers the missing chunks.
+//
+// Like Commit, does not take the runner's lock, as chunks are queried while
+// joining.
+func (handler *RPCHandler) MissingChunks(
+	args *chunk.MissingArgs,
+	reply *[]string,
+) error {
+	log.Trace().Int("Chunks", len(args.Hashes)).Msg("Executing MISSING CHUNKS RPC")
+	missing, err := chunk.Missing(handler.runner.DumpDir, args.Hashes)
+	if err != nil {
+		return err
+	}
+	*reply = missing
+	return nil
+}
+
+// Assemble a deduplicated dump that has been transferred to this runner. The
+// dump is verified against its manifest once assembled.
+//
+// Does not take the runner's lock, for the same reason as MissingChunks.
+func (handler *RPCHandler) AssembleDump(
+	args *chunk.AssembleArgs,
+	reply *struct{},
+) error {
+	log.Trace().Str("Dump", args.DumpName).Msg("Executing ASSEMBLE DUMP RPC")
+	err := chunk.Assemble(handler.runner.DumpDir, args.DumpName)
+	if err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Str("Dump", args.DumpName).
+			Msg("Failed to assemble dump")
+	}
+	return err
+}
+
+type PrepareMigrationArgs struct {
+	DumpNames   []string
+	ContainerId string
+}
+
+// Prepare the migration of a container to this runner, i.e. the first phase
+// of the migration.
+// Checks that the runner is standing by and has the complete, intact chain of
+// the migration.
+func (handler *RPCHandler) PrepareMigration(
+	args *PrepareMigrationArgs,
+	reply *struct{},
+) error {
+	log.Debug().
+		Strs("DumpNames", args.DumpNames).
+		Str("ContainerId", args.ContainerId).
+		Msg("Migration prepare request received")
+
+	if err := handler.checkMigration(args.DumpNames); err != nil {
+		return err
+	}
+
+	names := sortDumpNames(args.DumpNames)
+	latest := handler.runner.DumpDir.FromString(names[len(names)-1])
+	found, err := chain.ReconstructChain(latest.Path())
+	if err != nil {
+		return errors.Wrap(err, "Failed to reconstruct chain")
+	}
+	if len(found) != len(names) {
+		return errors.Errorf("Expected chain %v, found %v", names, found)
+	}
+	for i := range found {
+		if found[i] != names[i] {
+			return errors.Errorf("Expected chain %v, found %v", names, found)
+		}
+	}
+	return nil
+}
+
+// Check that the runner may receive a migration of the dumps, i.e. that it is
+// standing by and that the names are valid names of dumps.
+func (handler *RPCHandler) checkMigration(dumpNames []string) error {
+	if status := handler.runner.Status(); status != runner_context.StandBy {
+		return errors.Errorf("Runner is %s, not StandBy", status)
+	}
+	if len(dumpNames) == 0 {
+		return errors.New("No dumps to migrate")
+	}
+	for _, name := range dumpNames {
+		if !dump.IsDumpName(name) {
+			return errors.Errorf("Invalid dump name %s", name)
+		}
+	}
+	return nil
+}
+
 type MigrateArgs struct {
 	DumpNames               []string
 	ContainerId, BundlePath string
+	// The epoch the receiving runner becomes the source in.
+	Epoch int
+	// The other targets of the migrating runner, which the receiving runner
+	// should keep replicating to.
+	Targets []remote_target.RemoteTarget
 }
 
+// Commit the migration of a container to this runner, i.e. the second phase
+// of the migration.
+// Restores the container and returns once it is confirmed running. If the
+// container fails to be restored an error is returned, and the runner goes
+// back to standing by.
 func (handler *RPCHandler) Migrate(args *MigrateArgs, reply *struct{}) error {
 	log.Debug().Strs("DumpNames", args.DumpNames).Msg("Migration request received")
 
-	// Sort the names according to their numbers, in ascending order.
-	sort.SliceStable(args.DumpNames, func(i, j int) bool {
-		re_nr := regexp.MustCompile("[0-9]+")
-		n1, _ := strconv.Atoi(re_nr.FindString(args.DumpNames[i]))
-		n2, _ := strconv.Atoi(re_nr.FindString(args.DumpNames[j]))
-		return n1 < n2
+	if err := handler.runner.election.check(args.Epoch); err != nil {
+		return err
+	}
+	// The runner must still be standing by once locked, as nothing is sent on
+	// restored unless it starts restoring.
+	var err error
+	handler.runner.WithLock(func() {
+		if err = handler.checkMigration(args.DumpNames); err != nil {
+			return
+		}
+		for _, name := range sortDumpNames(args.DumpNames) {
+			dump := handler.runner.DumpDir.FromString(name)
+			handler.runner.Chain.Push(*dump)
+		}
+		handler.runner.ContainerId = args.ContainerId
+		handler.runner.BundlePath = args.BundlePath
+		err = handler.runner.SetStatusNoLock(runner_context.Restoring)
 	})
-
-	for _, name := range args.DumpNames {
-		dump := dump.FromString(name)
-		handler.runner.Chain.Push(*dump)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Refusing migration")
+		return err
 	}
-	handler.runner.ContainerId = args.ContainerId
-	handler.runner.BundlePath = args.BundlePath
-	handler.runner.SetStatus(runner_context.Restoring)
+	if err := <-handler.runner.restored; err != nil {
+		return err
+	}
+
+	// The container is running, take over as the source
+	handler.runner.election.observe(args.Epoch)
+	self := handler.runner.ToTarget()
+	handler.runner.WithLock(func() {
+		handler.runner.Source = ""
+		for _, target := range args.Targets {
+			if target.Id() != self.Id() {
+				handler.runner.AddTarget(target)
+			}
+		}
+	})
 	return nil
 }
+
+// Sort the names according to their numbers, in ascending order.
+func sortDumpNames(names []string) []string {
+	sorted := append([]string{}, names...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		re_nr := regexp.MustCompile("[0-9]+")
+		n1, _ := strconv.Atoi(re_nr.FindString(sorted[i]))
+		n2, _ := strconv.Atoi(re_nr.FindString(sorted[j]))
+		return n1 < n2
+	})
+	return sorted
+}
@@ -0,0 +1,48 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+)
+
+// Migrations that the runner cannot receive are refused rather than blocking
+// until a restore that never happens.
+func TestMigrateRefused(t *testing.T) {
+	runner := New("counter", t.TempDir())
+	migrate := func(names []string) error {
+		result := make(chan error, 1)
+		go func() {
+			var reply struct{}
+			result <- runner.RPCHandler.Migrate(&MigrateArgs{DumpNames: names}, &reply)
+		}()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("Migrate() did not return")
+			return nil
+		}
+	}
+
+	// Not standing by
+	if err := migrate([]string{"d1"}); err == nil {
+		t.Fatal("Migrate() succeeded while stopped")
+	}
+
+	if err := runner.SetStatus(runner_context.StandBy); err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range [][]string{nil, {"d1", "../d2"}} {
+		if err := migrate(names); err == nil {
+			t.Fatalf("Migrate(%v) succeeded", names)
+		}
+	}
+	if runner.Chain.Latest() != nil {
+		t.Fatal("Refused migration pushed dumps onto the chain")
+	}
+	if status := runner.Status(); status != runner_context.StandBy {
+		t.Fatalf("Status() = %s, want StandBy", status)
+	}
+}
@@ -2,14 +2,19 @@
 package runner
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 
 	"github.com/Xarepo/msc-container-migration/internal/chain"
@@ -19,13 +24,33 @@ import (
 	"github.com/Xarepo/msc-container-migration/internal/remote_target"
 	"github.com/Xarepo/msc-container-migration/internal/runc"
 	"github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
-	. "github.com/Xarepo/msc-container-migration/internal/runner/runner_context"
+	"github.com/Xarepo/msc-container-migration/internal/sftp"
+	"github.com/Xarepo/msc-container-migration/internal/transport"
+	"github.com/Xarepo/msc-container-migration/internal/usock_listener"
 	"github.com/Xarepo/msc-container-migration/internal/utils"
 )
 
 type Runner struct {
-	RunnerContext
+	runner_context.RunnerContext
 	RPCHandler
+	election election
+	// Set to 1 before the final dump of a migration freezes the container.
+	frozen int32
+	// The result of a migration that froze the container, true if the
+	// container was migrated and false if the migration was rolled back.
+	migrated chan bool
+	// The result of restoring a container migrated to this runner.
+	restored chan error
+	// Serves the RPCs of the runner.
+	rpcServer *rpc.Server
+	// Closed once the runner has been shut down, stopping its loop.
+	closed chan struct{}
+	// Whether or not the runner is hosted by a daemon, in which case a failed
+	// runner stops without exiting the process.
+	hosted bool
+	// The backoff of replicating to each target that failed to be synced, by
+	// target id. Should only be used while holding the lock.
+	syncBackoff *utils.Backoff
 }
 
 // Create a new runner.
@@ -35,14 +60,20 @@ type Runner struct {
 func New(containerId, bundlePath string) *Runner {
 	runner := Runner{
 		RunnerContext: runner_context.New(containerId, bundlePath),
+		migrated:      make(chan bool, 1),
+		restored:      make(chan error, 1),
+		rpcServer:     rpc.NewServer(),
+		closed:        make(chan struct{}),
+		syncBackoff:   utils.NewBackoff(_SYNC_BACKOFF, _MAX_SYNC_BACKOFF),
 	}
 	runner.RPCHandler = RPCHandler{runner: &runner}
+	runner.rpcServer.RegisterName("RPC", &runner.RPCHandler)
 	return &runner
 }
 
 // Start the runner.
-// This starts the runner's loop, IPC/RPC-listener and signals handler, and
-// sets the runner's status to standby.
+// This starts the runner's loop, IPC/RPC-listener, dump receiver and signals
+// handler, and sets the runner's status to standby.
 func (runner *Runner) Start() {
 	// Handle signals
 	go func() {
@@ -52,32 +83,121 @@ func (runner *Runner) Start() {
 
 			s := <-c
 			log.Debug().Str("Signal", s.String()).Msg("Received signal")
-			runner.SetStatus(runner_context.Terminated)
+			runner.Terminate()
 		}
 	}()
 
-	go runner.Loop()
-	go runner.IPCListener.Listen(func(buf []byte) {
-		ipc := ipc.ParseIPC(string(buf))
-		if ipc != nil {
-			ipc.Execute(&runner.RunnerContext)
-		} else {
-			log.Error().Msg("Failed to parse IPC")
-		}
-	})
-
 	// RPC listener
-	rpc.RegisterName("RPC", &runner.RPCHandler)
-	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", ":1234")
+	mux := http.NewServeMux()
+	mux.Handle(remote_target.RPCPath(runner.RPCName), runner.rpcServer)
+	l, e := net.Listen(
+		"tcp",
+		net.JoinHostPort(env.Getenv().RPC_IP, strconv.Itoa(runner.RPCPort())),
+	)
 	if e != nil {
 		log.Fatal().Msgf("listen error:%s", e)
 	}
-	go http.Serve(l, nil)
+	go http.Serve(l, mux)
+
+	go func() {
+		if err := ReceiveDumps(); err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Failed to receive dumps")
+		}
+	}()
+	runner.start()
+}
+
+// Start the runner's loop and IPC-listener, and set the runner's status to
+// standby.
+// Unlike Start, no signal handler, RPC listener nor dump receiver is started,
+// as these are shared by all runners hosted by a daemon. The daemon serves the
+// runner's RPCs with ServeRPC.
+func (runner *Runner) StartHosted() {
+	runner.hosted = true
+	runner.start()
+}
+
+func (runner *Runner) start() {
+	os.MkdirAll(runner.DumpDir.Path(), 0755)
+	go runner.Loop()
+	if runner.ContainerId != "" || runner.SockAddr != "" {
+		runner.listen()
+	}
 
 	runner.SetStatus(runner_context.StandBy)
 	log.Debug().Msg("Runner started, standing by")
-	os.MkdirAll("/dumps", os.ModeDir)
+}
+
+// Serve an HTTP request for the runner's RPCs.
+func (runner *Runner) ServeRPC(w http.ResponseWriter, req *http.Request) {
+	runner.rpcServer.ServeHTTP(w, req)
+}
+
+// Receive dumps from other nodes, with the transport of the environment.
+// Blocks for as long as dumps are being received.
+func ReceiveDumps() error {
+	t, err := transport.New(env.Getenv().TRANSPORT)
+	if err != nil {
+		return errors.Wrap(err, "Failed to select transport")
+	}
+	addr := net.JoinHostPort(
+		env.Getenv().FILE_TRANSFER_IP,
+		strconv.Itoa(env.Getenv().FILE_TRANSFER_PORT),
+	)
+	return t.Receive(addr)
+}
+
+// Fail the runner with the error. A standalone runner exits the process, while
+// a hosted runner is terminated, so that the daemon keeps running the runners
+// of its other containers.
+func (runner *Runner) fatal(err error, msg string) {
+	if !runner.hosted {
+		log.Fatal().Str("Error", err.Error()).Msg(msg)
+	}
+	log.Error().
+		Str("Error", err.Error()).
+		Str("ContainerId", runner.ContainerId).
+		Msg(msg)
+	runner.Terminate()
+}
+
+// Listen for IPCs on the runner's sockets, which are derived from the
+// container id unless the socket path has been set.
+func (runner *Runner) listen() {
+	if runner.SockAddr == "" {
+		runner.SockAddr = usock_listener.SockAddr(runner.ContainerId)
+	}
+	sockAddr := runner.SockAddr
+	go func() {
+		err := runner.IPCListener.Listen(sockAddr, func(buf []byte) []byte {
+			ipc := ipc.ParseIPC(string(buf))
+			if ipc == nil {
+				log.Error().Msg("Failed to parse IPC")
+				return nil
+			}
+			result, err := ipc.Execute(&runner.RunnerContext)
+			if err != nil {
+				log.Error().Str("Error", err.Error()).Msg("IPC failed")
+				return nil
+			}
+			log.Info().Interface("Result", result).Msg("IPC succeeded")
+			return nil
+		})
+		if err != nil {
+			runner.fatal(err, "Failed to listen for IPCs")
+		}
+	}()
+	go func() {
+		err := runner.ControlListener.Listen(
+			usock_listener.ControlAddr(sockAddr),
+			func(buf []byte) []byte {
+				return ipc.HandleRequest(buf, &runner.RunnerContext)
+			},
+		)
+		if err != nil {
+			runner.fatal(err, "Failed to listen for IPCs")
+		}
+	}()
 }
 
 // Start the container and set the status to running
@@ -87,28 +207,58 @@ func (runner *Runner) StartContainer() {
 	log.Debug().Msg("Runner running")
 }
 
-// Restore the container and set the status to running
+// Restore the container and set the status to running, or to failed if the
+// container could not be restored.
 func (runner *Runner) RestoreContainer() {
-	go runner.restoreContainer(runner.Chain.Latest().Dump().Path())
+	if err := runner.startRestore(runner.Chain.Latest().Dump().Path()); err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Failed to restore container")
+		runner.SetStatus(runner_context.Failed)
+		return
+	}
 	runner.NewChain()
 	runner.SetStatus(runner_context.Running)
 	log.Debug().Msg("Runner restored")
 }
 
+// Restore the container from a checkpoint, which becomes the base of the
+// runner's chains, and set the status to running, or to failed if the
+// container could not be restored.
+func (runner *Runner) RestoreCheckpoint(checkpoint dump.Dump) {
+	runner.Chain.Push(checkpoint)
+	runner.RestoreContainer()
+}
+
+// Restore the container from a dump in a goroutine, and wait until the
+// container is confirmed to be running or has failed to be restored.
+func (runner *Runner) startRestore(dumpPath string) error {
+	confirmed := make(chan error, 1)
+	go runner.restoreContainer(dumpPath, confirmed)
+	return <-confirmed
+}
+
 // Wait for the runner to finish running.
 func (runner *Runner) WaitForContainer() int {
 	return <-runner.ContainerStatus
 }
 
+// Stop the runner's loop and stop listening for IPCs, waiting for the
+// responses of requests being handled to be written.
+// Should only be called once the runner has stopped.
+func (runner *Runner) Shutdown() {
+	close(runner.closed)
+	runner.IPCListener.Close()
+	runner.ControlListener.Close()
+}
+
 // Wait for the runner to finish running.
 func (runner *Runner) WaitFor() {
-	for runner.Status() != runner_context.Failed &&
-		runner.Status() != runner_context.Stopped {
-	}
+	runner.WaitForStatus(runner_context.Failed, runner_context.Stopped)
 }
 
 func (runner *Runner) runContainer() {
-	status, err := runc.Run(runner.ContainerId, runner.BundlePath)
+	// The container is not run with the runc context of the runner, as it is
+	// killed by the runner once terminated.
+	status, err := runc.Run(context.Background(), runner.ContainerId, runner.BundlePath)
 	if err != nil {
 		if status == 137 {
 			log.Warn().Msg("Container exited with status 137 (SIGKILL), assuming it was checkpointed...")
@@ -121,11 +271,45 @@ func (runner *Runner) runContainer() {
 	} else {
 		log.Info().Int("Status", status).Msg("Container exited")
 	}
-	runner.ContainerStatus <- status
+	runner.reportExit(status)
 }
 
-func (runner *Runner) restoreContainer(dumpPath string) {
-	status, err := runc.Restore(runner.ContainerId, dumpPath, runner.BundlePath)
+// Restore the container from a dump and wait for it to exit.
+//
+// The result of the restore is sent to confirmed once the container is either
+// running or has failed to be restored. A container that fails to be restored
+// is not reported as exited, as it never ran.
+func (runner *Runner) restoreContainer(dumpPath string, confirmed chan<- error) {
+	var once sync.Once
+	confirm := func(err error) {
+		once.Do(func() { confirmed <- err })
+	}
+	var running int32
+	waitCtx, done := context.WithCancel(context.Background())
+	go func() {
+		if runc.WaitRunning(waitCtx, runner.ContainerId) == nil {
+			atomic.StoreInt32(&running, 1)
+			confirm(nil)
+		}
+	}()
+
+	status, err := runc.Restore(
+		runner.RuncContext(),
+		runner.ContainerId,
+		dumpPath,
+		runner.BundlePath,
+	)
+	done()
+	if err != nil && atomic.LoadInt32(&running) == 0 {
+		log.Error().
+			Str("Error", err.Error()).
+			Int("Status", status).
+			Msg("Failed to restore container")
+		confirm(errors.Wrap(err, "Failed to restore container"))
+		return
+	}
+	confirm(nil)
+
 	if err != nil {
 		if status == 137 {
 			log.Warn().Msg("Container exited with status 137 (SIGKILL), assuming it was checkpointed...")
@@ -138,12 +322,29 @@ func (runner *Runner) restoreContainer(dumpPath string) {
 	} else {
 		log.Info().Int("Status", status).Msg("Container exited")
 	}
+	runner.reportExit(status)
+}
+
+// Report the exit status of the container.
+//
+// A container that was killed by the final dump of a migration is only
+// reported once the migration has finished, as it is restored locally if the
+// migration is rolled back.
+func (runner *Runner) reportExit(status int) {
+	if atomic.CompareAndSwapInt32(&runner.frozen, 1, 0) && !<-runner.migrated {
+		log.Info().Msg("Migration rolled back, container restored locally")
+		return
+	}
 	runner.ContainerStatus <- status
 }
 
+// Run the runner's loop, until the runner is shut down.
+// Every cycle runs the action of the current status, and then waits for the
+// status to change before starting the next cycle.
 func (runner *Runner) Loop() {
 	for {
-		switch runner.Status() {
+		status := runner.Status()
+		switch status {
 		case runner_context.Running:
 			runner.loopRunning()
 		case runner_context.Migrating:
@@ -154,16 +355,25 @@ func (runner *Runner) Loop() {
 			runner.loopJoining()
 		case runner_context.StandBy:
 			runner.loopStandby()
+		case runner_context.Electing:
+			runner.loopElecting()
 		case runner_context.Recovery:
 			runner.loopRecovery()
 		case runner_context.Failed:
-			log.Fatal().Msg("The runner has failed")
+			if !runner.hosted {
+				log.Fatal().Msg("The runner has failed")
+			}
+			log.Error().
+				Str("ContainerId", runner.ContainerId).
+				Msg("The runner has failed")
+			return
 		case runner_context.Terminated:
 			runner.WithLock(func() {
 				log.Trace().
 					Str("ContainerId", runner.ContainerId).
 					Msg("Terminating runner")
-				err := runc.Kill(runner.ContainerId)
+				// The runc context of the runner has been cancelled by now
+				err := runc.Kill(context.Background(), runner.ContainerId)
 				if err != nil {
 					log.Error().
 						Str("Error", err.Error()).
@@ -173,8 +383,11 @@ func (runner *Runner) Loop() {
 				}
 				runner.SetStatusNoLock(runner_context.Stopped)
 			})
-			for runner.Status() == runner_context.Terminated {
-			}
+		}
+		select {
+		case <-runner.Leaving(status):
+		case <-runner.closed:
+			return
 		}
 	}
 }
@@ -183,6 +396,7 @@ func (runner *Runner) loopRunning() {
 	dumpTick := time.NewTicker(
 		time.Duration(env.Getenv().DUMP_INTERVAL) * time.Second,
 	)
+	defer dumpTick.Stop()
 	if !env.Getenv().ENABLE_CONTINOUS_DUMPING {
 		dumpTick.Stop()
 	}
@@ -190,12 +404,8 @@ func (runner *Runner) loopRunning() {
 	pingTick := time.NewTicker(
 		time.Duration(env.Getenv().PING_INTERVAL) * time.Second,
 	)
-	done := make(chan bool)
-	go func() {
-		for runner.Status() == runner_context.Running {
-		}
-		done <- true
-	}()
+	defer pingTick.Stop()
+	done := runner.Leaving(runner_context.Running)
 	for {
 		select {
 		case <-dumpTick.C:
@@ -217,7 +427,7 @@ func (runner *Runner) loopRunning() {
 				// The next dump should be based on the latest dump of the previous
 				// chain and the parent path should be empty (as to perform a "full"
 				// pre-dump).
-				nextDump := dump.FirstDump() // 1)
+				nextDump := runner.DumpDir.FirstDump() // 1)
 				parentPath := ""
 				if runner.Chain.Latest() != nil { // 2)
 					nextDump = runner.Chain.Latest().Dump().NextDump(runner.Chain.Length())
@@ -228,151 +438,148 @@ func (runner *Runner) loopRunning() {
 					parentPath = ""
 				}
 
+				var err error
 				if nextDump.PreDump() {
-					runc.PreDump(
+					err = runc.PreDump(
+						runner.RuncContext(),
 						runner.ContainerId,
 						nextDump.Path(),
 						parentPath,
 					)
 				} else {
-					runc.Dump(
+					err = runc.Dump(
+						runner.RuncContext(),
 						runner.ContainerId,
 						nextDump.Path(),
 						parentPath,
 						true,
 					)
 				}
+				if err != nil {
+					// The failed dump is not pushed, so the next dump is taken in its
+					// place.
+					var runcErr *runc.Error
+					if errors.As(err, &runcErr) &&
+						errors.Is(runcErr.Err, context.Canceled) {
+						// The runner is terminating.
+						log.Debug().
+							Str("Op", runcErr.Op).
+							Str("Dump", nextDump.Base()).
+							Msg("Dump cancelled")
+					} else {
+						log.Error().
+							Str("Error", err.Error()).
+							Str("Dump", nextDump.Base()).
+							Msg("Failed to dump container")
+					}
+					os.RemoveAll(nextDump.Path())
+					return
+				}
 
 				runner.Chain.Push(*nextDump)
-				for _, target := range runner.Targets {
-					runner.Chain.Sync(&target)
-				}
+				runner.syncTargets()
 
 				if !nextDump.PreDump() {
 					runner.NewChain()
 				}
 			})
 		case <-pingTick.C:
-			for _, target := range runner.Targets {
-				log.Trace().Str("Target", target.RPCAddr()).Msg("Pinging remote")
-
-				var client *rpc.Client
-				var err error
-				var reply bool
-				var args struct{}
-				// false/true in the channel indicates a failed/successful call, but
-				// not necessarily a response.
-				sync := make(chan bool)
-
-				// Call RPC in a go routine in order to implement timeout behavior, as
-				// net/rpc has no support for timeouts.
-				go func() {
-					client, err = rpc.DialHTTP("tcp", target.RPCAddr())
-					if err != nil {
-						log.Fatal().Msgf("dialing:%s", err)
-					}
-					err = client.Call("RPC.Ping", args, &reply)
-					if err != nil {
-						log.Warn().
-							Str("Error", err.Error()).
-							Str("Target", target.RPCAddr()).
-							Msg("Failed to call PING RPC")
-						runner.RemoveTarget(target)
-						sync <- false
-					} else {
-						sync <- true
-					}
-				}()
-				select {
-				case success := <-sync:
-					if success && reply == true {
-						log.Trace().Str("Target", target.RPCAddr()).Msg("PING RECEIVED")
-					}
-				case <-time.After(3 * time.Second): // TODO: Don't hardcode ping timeout
-					log.Warn().
-						Str("Target", target.RPCAddr()).
-						Msg("No ping received from target")
-					runner.RemoveTarget(target)
-					if client != nil {
-						client.Close()
-					}
-				}
-			}
+			runner.pingTargets("")
 		case <-done:
 			return
 		}
 	}
 }
 
-func (runner *Runner) loopMigrating() {
-	runner.WithLock(func() {
-		log.Debug().
-			Str("ContainerId", runner.ContainerId).
-			Msg("Migrating container")
-
-		// Pre-dump
-		nextDump := dump.FirstDump()
-		parentPath := ""
-		if runner.Chain.Latest() != nil {
-			nextDump = runner.Chain.Latest().Dump().NextPreDump()
-			parentPath = runner.Chain.Latest().Dump().ParentPath()
-		}
-		// If the current chain is empty but the previous one is not when
-		// migrating, rather than creating the first dump in the current chain, the
-		// next dump should be linked to the previous chain as this will be more
-		// effective. This is equivalent to setting the current chain to the
-		// previous chain.
-		if runner.Chain.Latest() == nil &&
-			runner.PrevChain != nil && runner.PrevChain.Latest() != nil {
-			runner.Chain = runner.PrevChain
-			runner.PrevChain = nil
-			nextDump = runner.Chain.Latest().Dump().NextPreDump()
-			parentPath = runner.Chain.Latest().Dump().ParentPath()
+// Ping the targets, except for the target with the given id if any, so that
+// they do not elect a new source. Targets that fail to reply are removed.
+func (runner *Runner) pingTargets(exclude string) {
+	for _, target := range runner.Targets {
+		if target.Id() == exclude {
+			continue
 		}
-		runner.Chain.Push(*nextDump)
-		runc.PreDump(
-			runner.ContainerId,
-			nextDump.Path(),
-			parentPath,
-		)
-		runner.Chain.Sync(&runner.Targets[0])
-
-		// Dump
-		nextDump = nextDump.NextFullDump()
-		runner.Chain.Push(*nextDump)
-		runc.Dump(
-			runner.ContainerId,
-			nextDump.Path(),
-			runner.Chain.Latest().Dump().ParentPath(),
-			false)
-		runner.Chain.Sync(&runner.Targets[0])
-
-		client, err := rpc.DialHTTP("tcp", runner.Targets[0].RPCAddr())
-		if err != nil {
-			log.Fatal().Msgf("dialing:%s", err)
+		log.Trace().Str("Target", target.RPCAddr()).Msg("Pinging remote")
+
+		var client *rpc.Client
+		var err error
+		var reply bool
+		args := PingArgs{
+			Epoch:   runner.election.Epoch(),
+			Source:  runner.ToTarget().Id(),
+			Targets: runner.Targets,
 		}
+		// false/true in the channel indicates a failed/successful call, but
+		// not necessarily a response.
+		sync := make(chan bool)
 
-		var reply struct{}
-		args := MigrateArgs{
-			DumpNames:   runner.Chain.GetNames(),
-			ContainerId: runner.ContainerId,
-			BundlePath:  runner.BundlePath,
-		}
-		err = client.Call("RPC.Migrate", args, &reply)
-		if err != nil {
-			log.Error().Str("Error", err.Error()).Msg("Failed to call RPC")
-			runner.SetStatusNoLock(runner_context.Failed)
-			return
+		// Call RPC in a go routine in order to implement timeout behavior, as
+		// net/rpc has no support for timeouts.
+		go func() {
+			client, err = target.Dial()
+			if err != nil {
+				log.Warn().
+					Str("Error", err.Error()).
+					Str("Target", target.RPCAddr()).
+					Msg("Failed to dial target")
+				runner.RemoveTarget(target)
+				sync <- false
+				return
+			}
+			err = client.Call("RPC.Ping", args, &reply)
+			if isStaleEpoch(err) {
+				// A standby has been elected as the new source, so this runner
+				// must not keep running the container.
+				log.Error().
+					Str("Error", err.Error()).
+					Str("Target", target.RPCAddr()).
+					Msg("Fenced by newer epoch, terminating")
+				runner.Terminate()
+				sync <- false
+			} else if err != nil {
+				log.Warn().
+					Str("Error", err.Error()).
+					Str("Target", target.RPCAddr()).
+					Msg("Failed to call PING RPC")
+				runner.RemoveTarget(target)
+				sync <- false
+			} else {
+				sync <- true
+			}
+		}()
+		select {
+		case success := <-sync:
+			if success && reply == true {
+				log.Trace().Str("Target", target.RPCAddr()).Msg("PING RECEIVED")
+				runner.SetLastPing(target.Id())
+			}
+		case <-time.After(3 * time.Second): // TODO: Don't hardcode ping timeout
+			log.Warn().
+				Str("Target", target.RPCAddr()).
+				Msg("No ping received from target")
+			runner.RemoveTarget(target)
+			if client != nil {
+				client.Close()
+			}
 		}
-
-		runner.SetStatusNoLock(runner_context.Stopped)
-	})
+	}
 }
 
+// Restore the container as part of a migration, and send the result to the
+// MIGRATE RPC that requested it.
 func (runner *Runner) loopRestoring() {
 	runner.WithLock(func() {
 		log.Trace().Msg("Restoring container")
-		go runner.restoreContainer(runner.Chain.Latest().Dump().Path())
+		err := runner.startRestore(runner.Chain.Latest().Dump().Path())
+		if err != nil {
+			log.Error().
+				Str("Error", err.Error()).
+				Str("ContainerId", runner.ContainerId).
+				Msg("Failed to restore container, standing by")
+			runner.Chain = chain.New()
+			runner.SetStatusNoLock(runner_context.StandBy)
+			runner.restored <- err
+			return
+		}
 		log.Info().
 			Str("ContainerId", runner.ContainerId).
 			Str("Dump", runner.Chain.Latest().Dump().Path()).
@@ -380,6 +587,7 @@ func (runner *Runner) loopRestoring() {
 			Msg("Container restored")
 		runner.NewChain()
 		runner.SetStatusNoLock(runner_context.Running)
+		runner.restored <- nil
 	})
 }
 
@@ -387,13 +595,39 @@ func (runner *Runner) loopJoining() {
 	runner.WithLock(func() {
 		log.Trace().Str("Remote", runner.Source).Msg("Joining cluster")
 
-		client, err := rpc.DialHTTP("tcp", runner.Source)
+		client, err := remote_target.Dial(runner.Source)
 		if err != nil {
 			log.Error().Str("Error", err.Error()).Msg("Failed to dial RPC")
 			runner.SetStatusNoLock(runner_context.Failed)
 			return
 		}
 
+		// The dumps are kept in the directory of the container, which must be
+		// known before the source starts transferring dumps while joining.
+		var containerId string
+		err = client.Call("RPC.Container", &struct{}{}, &containerId)
+		if err == nil {
+			err = dump.ValidContainerId(containerId)
+		}
+		if err != nil {
+			log.Error().
+				Str("Error", err.Error()).
+				Msg("Failed to get the container of the cluster")
+			runner.SetStatusNoLock(runner_context.Failed)
+			return
+		}
+		if runner.ContainerId != "" && runner.ContainerId != containerId {
+			log.Error().
+				Str("ContainerId", runner.ContainerId).
+				Str("Remote", containerId).
+				Msg("Joined cluster runs another container")
+			runner.SetStatusNoLock(runner_context.Failed)
+			return
+		}
+		runner.ContainerId = containerId
+		runner.DumpDir = dump.ContainerDir(containerId)
+		os.MkdirAll(runner.DumpDir.Path(), 0755)
+
 		var reply string
 		args := runner.ToTarget()
 		err = client.Call("RPC.Join", args, &reply)
@@ -403,7 +637,19 @@ func (runner *Runner) loopJoining() {
 			return
 		}
 
-		runner.ContainerId = reply
+		if reply != containerId {
+			log.Error().
+				Str("ContainerId", containerId).
+				Str("Remote", reply).
+				Msg("Joined cluster runs another container")
+			runner.SetStatusNoLock(runner_context.Failed)
+			return
+		}
+		if runner.SockAddr == "" {
+			// The sockets are named after the container, which was not known
+			// until now.
+			runner.listen()
+		}
 
 		log.Info().Str("ContainerId", reply).Msg("Successfully joined cluster")
 		runner.SetStatusNoLock(runner_context.StandBy)
@@ -412,22 +658,17 @@ func (runner *Runner) loopJoining() {
 
 func (runner *Runner) loopStandby() {
 	if runner.Source != "" {
-		done := make(chan bool)
-		go func() {
-			for runner.Status() == runner_context.StandBy {
-			}
-			done <- true
-		}()
+		done := runner.Leaving(runner_context.StandBy)
 		for {
 			pingTimeout := time.Duration(env.Getenv().PING_TIMEOUT) * time.Second
 			select {
 			case <-time.After(pingTimeout):
 				log.Warn().
 					Msgf(
-						"No ping received in %s. Assuming source is down. Starting recovery",
+						"No ping received in %s. Assuming source is down. Starting election",
 						pingTimeout.String(),
 					)
-				runner.SetStatus(runner_context.Recovery)
+				runner.SetStatus(runner_context.Electing)
 			case <-runner.PingInterrupt:
 			case <-done:
 				return
@@ -439,7 +680,7 @@ func (runner *Runner) loopStandby() {
 func (runner *Runner) loopRecovery() {
 	log.Trace().Msg("Recovering")
 
-	latestDump, err := dump.Recover()
+	candidates, err := runner.DumpDir.Recoverable()
 	if err != nil {
 		log.Error().
 			Str("Error", err.Error()).
@@ -448,15 +689,27 @@ func (runner *Runner) loopRecovery() {
 		return
 	}
 
-	chain, err := chain.ReconstructChain(latestDump.Path())
+	// Use the latest dump whose chain is intact, falling back to earlier chains
+	// if it is corrupt.
+	var names []string
+	for _, candidate := range candidates {
+		names, err = chain.ReconstructChain(candidate.Path())
+		if err == nil {
+			break
+		}
+		log.Warn().
+			Str("Error", err.Error()).
+			Str("Dump", candidate.Base()).
+			Msg("Failed to reconstruct dump chain, falling back to earlier dump")
+	}
 	if err != nil {
-		log.Error().Str("Error", err.Error()).Msg("Failed to reconstruct dump chain")
+		log.Error().Msg("Failed to find a valid dump chain to recover from")
 		runner.SetStatus(runner_context.Failed)
 		return
 	}
-	log.Debug().Strs("Chain", chain).Msg("Chain to restore from determined")
-	for _, name := range chain {
-		d := dump.FromString(name)
+	log.Debug().Strs("Chain", names).Msg("Chain to restore from determined")
+	for _, name := range names {
+		d := runner.DumpDir.FromString(name)
 		runner.Chain.Push(*d)
 	}
 
@@ -468,12 +721,145 @@ func (runner *Runner) loopRecovery() {
 	runner.RestoreContainer()
 }
 
+// The backoff before syncing to a target again after a failed sync, which
+// doubles with every consecutive failure, and its maximum.
+const (
+	_SYNC_BACKOFF     = time.Second
+	_MAX_SYNC_BACKOFF = time.Minute
+)
+
+// Sync the current chain to all targets.
+// A target that failed to be synced is retried by later syncs once its backoff
+// has passed, rather than by waiting for it while holding the lock.
+// Should be called while holding the lock.
+func (runner *Runner) syncTargets() {
+	for i := range runner.Targets {
+		target := &runner.Targets[i]
+		if !runner.syncBackoff.Ready(target.Id()) {
+			log.Debug().
+				Str("Target", target.Id()).
+				Msg("Backing off from syncing to target")
+			continue
+		}
+		if err := runner.syncTarget(target); err != nil {
+			delay := runner.syncBackoff.Fail(target.Id())
+			log.Warn().
+				Str("Target", target.Id()).
+				Int("Failures", runner.syncBackoff.Failures(target.Id())).
+				Str("Backoff", delay.String()).
+				Msg("Retrying sync to target after backoff")
+			continue
+		}
+		runner.syncBackoff.Succeed(target.Id())
+	}
+}
+
+// Sync the current chain to the target and, if successful, commit its latest
+// dump on the target. Dumps that fail to sync are left unsynced, and are
+// transferred again on the next sync.
+// Should be called while holding the lock, unless the caller is the only one
+// pushing onto the chain, as when migrating.
+func (runner *Runner) syncTarget(target *remote_target.RemoteTarget) error {
+	if err := runner.Chain.Sync(target); err != nil {
+		event := log.Error().
+			Str("Error", err.Error()).
+			Str("Target", target.Id())
+		var transferErr *transport.TransferError
+		if errors.As(err, &transferErr) {
+			event = event.Str("Dump", transferErr.Dump)
+		}
+		event.Msg("Failed to sync chain to target")
+		return err
+	}
+	if runner.Chain.Latest() == nil {
+		return nil
+	}
+	if err := runner.commitDump(target, runner.Chain.Latest().Dump()); err != nil {
+		// The target may have refused the dump as corrupt, so transfer it again.
+		runner.Chain.Unsync(target)
+		return err
+	}
+	return nil
+}
+
+// Commit a dump, that has been synced, on the target.
+// Fails unless the target acknowledged the commit.
+func (runner *Runner) commitDump(
+	target *remote_target.RemoteTarget,
+	d *dump.Dump,
+) error {
+	client, err := target.Dial()
+	if err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Str("Target", target.Id()).
+			Msg("Failed to dial RPC")
+		return errors.Wrap(err, "Failed to dial RPC")
+	}
+	defer client.Close()
+
+	var reply string
+	args := CommitArgs{ContainerId: runner.ContainerId, DumpName: d.Base()}
+	err = client.Call("RPC.Commit", args, &reply)
+	if err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Str("Target", target.Id()).
+			Str("Dump", d.Base()).
+			Msg("Failed to call COMMIT RPC")
+		return errors.Wrapf(err, "Failed to commit dump %s", d.Base())
+	}
+	log.Debug().
+		Str("Target", target.Id()).
+		Str("Dump", reply).
+		Msg("Dump commit acknowledged")
+	return nil
+}
+
+// Tell the targets to follow a new source, that took over the container in the
+// given epoch.
+func (runner *Runner) announceSource(
+	targets []remote_target.RemoteTarget,
+	epoch int,
+	source remote_target.RemoteTarget,
+) {
+	for _, target := range targets {
+		if target.Id() == source.Id() {
+			continue
+		}
+		var reply struct{}
+		args := FollowArgs{Epoch: epoch, Source: source.Id()}
+		if err := callWithTimeout(&target, "RPC.Follow", args, &reply); err != nil {
+			log.Warn().
+				Str("Error", err.Error()).
+				Str("Target", target.Id()).
+				Msg("Failed to tell target to follow new source")
+			continue
+		}
+		log.Debug().
+			Str("Target", target.Id()).
+			Str("Source", source.Id()).
+			Msg("Target follows new source")
+	}
+}
+
 // Get the current runner represented as a remote target.
+// Runners advertise the codecs they accept, and, if receiving dumps over SFTP,
+// the fingerprint of their host key, which the source verifies when
+// transferring dumps.
 func (runner *Runner) ToTarget() remote_target.RemoteTarget {
-	return remote_target.New(
-		utils.GetLocalIP(),
-		runner.RPCPort(),
-		env.Getenv().DUMP_PATH,
-		22, // TODO: Don't hard code port
+	target := remote_target.New(
+		env.Getenv().RPC_ADVERTISE_HOST,
+		env.Getenv().RPC_ADVERTISE_PORT,
+		runner.RPCName,
+		runner.DumpDir.Path(),
+		env.Getenv().FILE_TRANSFER_ADVERTISE_HOST,
+		env.Getenv().FILE_TRANSFER_ADVERTISE_PORT,
+		env.Getenv().TRANSPORT,
 	)
+	target.Codecs = env.Getenv().COMPRESSION
+	if env.Getenv().TRANSPORT == transport.SFTP {
+		target.HostKey = sftp.HostKeyFingerprint()
+	}
+	return target
 }
@@ -1,11 +1,14 @@
 package runner_context
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/Xarepo/msc-container-migration/internal/chain"
+	"github.com/Xarepo/msc-container-migration/internal/dump"
 	"github.com/Xarepo/msc-container-migration/internal/env"
 	. "github.com/Xarepo/msc-container-migration/internal/ipc_listener"
 	"github.com/Xarepo/msc-container-migration/internal/remote_target"
@@ -45,9 +48,16 @@ import (
 // NOTE: The runner should always have this status for EXACTLY one cycle of the
 // runner's loop.
 //
-// Recovery:
+// Electing:
 // The runner has lost connection to the source, i.e. pings have timed out, and
-// is in the process of recovery from the latest possible dump.
+// is asking the other standbys to elect it as the new source. If elected it
+// transitions into recovery, otherwise it goes back to standby and follows the
+// standby that was elected.
+//
+// Recovery:
+// The runner has been elected as the new source after losing connection to
+// the previous one, and is in the process of recovery from the latest
+// possible dump.
 // NOTE: The runner should always have this status for EXACTLY one cycle of the
 // runner's loop.
 //
@@ -58,6 +68,9 @@ import (
 // Terminated:
 // The runner has been deliberatly terminated via user input, e.g. signals
 // SIGTERM or SIGINT.
+//
+// The statuses the runner may transition between are listed in status.go.
+// Transitions not listed there are rejected.
 type RunnerStatus string
 
 const (
@@ -67,6 +80,7 @@ const (
 	Migrating               = "Migrating"
 	Restoring               = "Restoring"
 	Joining                 = "Joining"
+	Electing                = "Electing"
 	Recovery                = "Recovery"
 	Failed                  = "Failed"
 	Terminated              = "Terminated"
@@ -83,58 +97,140 @@ type RunnerContext struct {
 	ContainerStatus chan int
 	// The path to the OCI-bundle that the runner's container is created from.
 	BundlePath string
+	// The directory the runner keeps its dumps in.
+	DumpDir dump.Dir
+	// The name the runner's RPCs are served under, when hosted by a daemon.
+	// Empty for standalone runners.
+	RPCName string
+	// The path of the socket to listen for IPCs on. If empty, the path is
+	// derived from the container id.
+	SockAddr string
+	// Listens for one-way IPCs, e.g. from inside the container.
 	IPCListener
-	rpcPort int
-	status  RunnerStatus
-	lock    sync.Mutex
+	// Listens for IPC requests from the CLI, which are answered with a
+	// response.
+	ControlListener IPCListener
+	rpcPort         int
+	status          *statusMachine
+	lock            sync.Mutex
+	// The context of the runc operations of the runner, cancelled once the
+	// runner is terminated.
+	runcCtx    context.Context
+	cancelRunc context.CancelFunc
 	// A list of targets of which to replicate when the runner is running.
 	Targets []remote_target.RemoteTarget
 	// The address of the source node to listen to for migrations. This will be
 	// empty if the runner is running.
-	Source           string
+	Source string
+	// The id of the target to migrate to, set when a migration is requested.
+	MigrationTarget string
+	// The maximum downtime of the requested migration, zero if unlimited.
+	MigrationMaxDowntime time.Duration
+	// The reason the latest migration was aborted, nil if it succeeded.
+	MigrationError   error
 	PingInterrupt    chan bool
 	Chain, PrevChain *chain.DumpChain
+	// The time of the latest successful ping to or from each runner, by id.
+	pings map[string]time.Time
+	// The id of the source, as sent in its pings.
+	sourceId string
+	pingLock sync.Mutex
+	// The state of the runner as of the last time it released its lock.
+	snapshot     Snapshot
+	snapshotLock sync.Mutex
 }
 
 func New(containerId, bundlePath string) RunnerContext {
+	runcCtx, cancelRunc := context.WithCancel(context.Background())
 	return RunnerContext{
 		ContainerId:     containerId,
-		ContainerStatus: make(chan int),
+		ContainerStatus: make(chan int, 1),
 		BundlePath:      bundlePath,
+		DumpDir:         dump.RunnerDir(containerId),
 		IPCListener:     &USockListener{},
+		ControlListener: &USockStreamListener{},
 		rpcPort:         env.Getenv().RPC_PORT,
-		status:          Stopped,
+		status:          newStatusMachine(Stopped),
 		Targets:         []remote_target.RemoteTarget{},
 		Source:          "",
 		PingInterrupt:   make(chan bool),
 		Chain:           chain.New(),
 		PrevChain:       nil,
+		pings:           map[string]time.Time{},
+		runcCtx:         runcCtx,
+		cancelRunc:      cancelRunc,
 	}
 }
 
-// Sets the status of the runner after locking
-func (ctx *RunnerContext) SetStatus(status RunnerStatus) {
+// Sets the status of the runner after locking.
+// Returns an error, and leaves the status unchanged, if the runner may not
+// transition from its current status into the status.
+func (ctx *RunnerContext) SetStatus(status RunnerStatus) error {
+	var err error
 	ctx.WithLock(func() {
-		log.Debug().Str("Status", string(status)).Msg("Status set")
-		ctx.status = status
+		err = ctx.SetStatusNoLock(status)
 	})
+	return err
 }
 
 // Sets the status of the runner without locking.
 // Useful for when needing to set the status from within the callback passed to
 // WithLock().
-func (ctx *RunnerContext) SetStatusNoLock(status RunnerStatus) {
-	log.Debug().Str("Status", string(status)).Msg("Status set")
-	ctx.status = status
+func (ctx *RunnerContext) SetStatusNoLock(status RunnerStatus) error {
+	err := ctx.status.transition(status)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Failed to set status")
+	}
+	return err
+}
+
+// Terminate the runner, killing its container.
+// The status is set without locking, as the runner may be holding the lock
+// while waiting for a runc operation, e.g. a hung dump. The runc operations of
+// the runner are only cancelled once the runner is terminated, so that a
+// rejected termination does not cancel the operations of a runner that keeps
+// running.
+func (ctx *RunnerContext) Terminate() error {
+	if err := ctx.SetStatusNoLock(Terminated); err != nil {
+		return err
+	}
+	ctx.cancelRunc()
+	return nil
+}
+
+// Return the context to perform the runc operations of the runner with, which
+// is cancelled once the runner is terminated.
+func (ctx *RunnerContext) RuncContext() context.Context {
+	return ctx.runcCtx
 }
 
 // Return the status of the runner.
 func (ctx *RunnerContext) Status() RunnerStatus {
-	return ctx.status
+	return ctx.status.get()
+}
+
+// Return a channel that is closed once the runner leaves the given status.
+// The channel is already closed if the runner does not have the given status.
+func (ctx *RunnerContext) Leaving(status RunnerStatus) <-chan struct{} {
+	return ctx.status.leaving(status)
+}
+
+// Block until the runner has any of the given statuses, and return the status.
+func (ctx *RunnerContext) WaitForStatus(statuses ...RunnerStatus) RunnerStatus {
+	return ctx.status.waitFor(statuses...)
 }
 
 // Add a target to the targets list.
+// A target with the same id as an existing target replaces it, e.g. when a
+// target rejoins the cluster.
 func (ctx *RunnerContext) AddTarget(target remote_target.RemoteTarget) {
+	for i, t := range ctx.Targets {
+		if t.Id() == target.Id() {
+			ctx.Targets[i] = target
+			log.Info().Str("Target", target.Id()).Msg("Replaced target")
+			return
+		}
+	}
 	ctx.Targets = append(ctx.Targets, target)
 	log.Info().
 		Str("RemoteTarget", target.Host).
@@ -143,11 +239,21 @@ func (ctx *RunnerContext) AddTarget(target remote_target.RemoteTarget) {
 		Msg("Added target")
 }
 
+// Return the target with the given id, or nil if there is no such target.
+func (ctx *RunnerContext) GetTarget(id string) *remote_target.RemoteTarget {
+	for i := range ctx.Targets {
+		if ctx.Targets[i].Id() == id {
+			return &ctx.Targets[i]
+		}
+	}
+	return nil
+}
+
 // Remove a target from the targets list
 func (ctx *RunnerContext) RemoveTarget(target remote_target.RemoteTarget) {
 	index := -1
 	for i, t := range ctx.Targets {
-		if t.RPCAddr() == target.RPCAddr() {
+		if t.Id() == target.Id() {
 			index = i
 		}
 	}
@@ -159,16 +265,51 @@ func (ctx *RunnerContext) RemoveTarget(target remote_target.RemoteTarget) {
 	}
 }
 
+// Record a successful ping to or from the runner with the given id.
+func (ctx *RunnerContext) SetLastPing(id string) {
+	ctx.pingLock.Lock()
+	defer ctx.pingLock.Unlock()
+	ctx.pings[id] = time.Now()
+}
+
+// Return the time of the latest successful ping to or from the runner with the
+// given id, or the zero time if there has been none.
+func (ctx *RunnerContext) LastPing(id string) time.Time {
+	ctx.pingLock.Lock()
+	defer ctx.pingLock.Unlock()
+	return ctx.pings[id]
+}
+
+// Record a ping from the source with the given id.
+// The source is recorded by the id it sends, rather than the address it was
+// joined at, which may differ, e.g. if the source advertises another host.
+func (ctx *RunnerContext) SetSourcePing(id string) {
+	ctx.pingLock.Lock()
+	defer ctx.pingLock.Unlock()
+	ctx.sourceId = id
+	ctx.pings[id] = time.Now()
+}
+
+// Return the time of the latest ping from the source, or the zero time if
+// there has been none.
+func (ctx *RunnerContext) SourceLastPing() time.Time {
+	ctx.pingLock.Lock()
+	defer ctx.pingLock.Unlock()
+	return ctx.pings[ctx.sourceId]
+}
+
 // Return the RPC port of the runner.
 func (ctx *RunnerContext) RPCPort() int {
 	return ctx.rpcPort
 }
 
 // Locks the context's lock and calls a function.
-// Handles both locking and unlocking of the lock.
+// Handles both locking and unlocking of the lock, and takes a snapshot of the
+// runner before unlocking.
 func (ctx *RunnerContext) WithLock(f func()) {
 	ctx.lock.Lock()
 	f()
+	ctx.takeSnapshot()
 	ctx.lock.Unlock()
 }
 
@@ -0,0 +1,65 @@
+package runner_context
+
+import (
+	"github.com/Xarepo/msc-container-migration/internal/chain"
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+)
+
+// Snapshot is a copy of the state of a runner, taken every time the runner
+// releases its lock. It can be read without waiting for the lock, which the
+// runner may hold for long, e.g. while dumping or migrating.
+type Snapshot struct {
+	ContainerId, BundlePath string
+	DumpDir                 dump.Dir
+	// The RPC address of the source, empty if the runner is the source.
+	Source string
+	// The dumps of the current and previous chain, latest first.
+	Chain, PrevChain []DumpSnapshot
+	Targets          []remote_target.RemoteTarget
+}
+
+type DumpSnapshot struct {
+	Name string
+	// The ids of the targets the dump has been synced to.
+	SyncedTargets []string
+}
+
+// Return the latest snapshot of the runner.
+func (ctx *RunnerContext) Snapshot() Snapshot {
+	ctx.snapshotLock.Lock()
+	defer ctx.snapshotLock.Unlock()
+	return ctx.snapshot
+}
+
+// Take a snapshot of the runner.
+// Should be called while holding the lock.
+func (ctx *RunnerContext) takeSnapshot() {
+	snapshot := Snapshot{
+		ContainerId: ctx.ContainerId,
+		BundlePath:  ctx.BundlePath,
+		DumpDir:     ctx.DumpDir,
+		Source:      ctx.Source,
+		Chain:       dumpSnapshots(ctx.Chain),
+		PrevChain:   dumpSnapshots(ctx.PrevChain),
+		Targets:     append([]remote_target.RemoteTarget{}, ctx.Targets...),
+	}
+	ctx.snapshotLock.Lock()
+	ctx.snapshot = snapshot
+	ctx.snapshotLock.Unlock()
+}
+
+// Return the snapshots of the dumps of the chain, latest first.
+func dumpSnapshots(c *chain.DumpChain) []DumpSnapshot {
+	snapshots := []DumpSnapshot{}
+	if c == nil {
+		return snapshots
+	}
+	for next := c.Latest(); next != nil; next = next.GetPrev() {
+		snapshots = append(snapshots, DumpSnapshot{
+			Name:          next.Dump().Base(),
+			SyncedTargets: next.SyncedTargets(),
+		})
+	}
+	return snapshots
+}
@@ -0,0 +1,100 @@
+package runner_context
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// The statuses each status may transition into. Setting the status to the
+// current status is always allowed, and has no effect.
+var transitions = map[RunnerStatus][]RunnerStatus{
+	Stopped:    {StandBy, Terminated},
+	StandBy:    {Running, Joining, Restoring, Electing, Stopped, Terminated},
+	Joining:    {StandBy, Failed, Terminated},
+	Running:    {Migrating, Stopped, Failed, Terminated},
+	Migrating:  {Running, Stopped, Failed, Terminated},
+	Restoring:  {Running, StandBy, Failed, Terminated},
+	Electing:   {StandBy, Recovery, Terminated},
+	Recovery:   {Running, Failed, Terminated},
+	Terminated: {Stopped, Failed},
+	Failed:     {},
+}
+
+// statusMachine holds the status of the runner, and notifies waiters when it
+// changes.
+type statusMachine struct {
+	lock   sync.Mutex
+	status RunnerStatus
+	// Closed, and replaced, every time the status changes.
+	changed chan struct{}
+}
+
+func newStatusMachine(status RunnerStatus) *statusMachine {
+	return &statusMachine{status: status, changed: make(chan struct{})}
+}
+
+func (sm *statusMachine) get() RunnerStatus {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return sm.status
+}
+
+// Transition into the status, if allowed from the current status.
+func (sm *statusMachine) transition(status RunnerStatus) error {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if status == sm.status {
+		return nil
+	}
+	if !allowed(sm.status, status) {
+		return errors.Errorf("Illegal transition from %s to %s", sm.status, status)
+	}
+
+	log.Debug().
+		Str("From", string(sm.status)).
+		Str("Status", string(status)).
+		Msg("Status set")
+	sm.status = status
+	close(sm.changed)
+	sm.changed = make(chan struct{})
+	return nil
+}
+
+// Return a channel that is closed once the status is no longer the given
+// status. The channel is already closed if the status is not the given status.
+func (sm *statusMachine) leaving(status RunnerStatus) <-chan struct{} {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.status != status {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return sm.changed
+}
+
+// Block until the status is any of the given statuses, and return it.
+func (sm *statusMachine) waitFor(statuses ...RunnerStatus) RunnerStatus {
+	for {
+		sm.lock.Lock()
+		status, changed := sm.status, sm.changed
+		sm.lock.Unlock()
+		for _, s := range statuses {
+			if status == s {
+				return status
+			}
+		}
+		<-changed
+	}
+}
+
+func allowed(from, to RunnerStatus) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package runner_context
+
+import "testing"
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		from, to RunnerStatus
+		allowed  bool
+	}{
+		{Stopped, StandBy, true},
+		{StandBy, Running, true},
+		{StandBy, Electing, true},
+		{Running, Migrating, true},
+		{Migrating, Running, true},
+		{Running, Terminated, true},
+		{Terminated, Stopped, true},
+		{Electing, Recovery, true},
+		{Stopped, Running, false},
+		{Running, StandBy, false},
+		{Joining, Running, false},
+		// Setting the current status again is a no-op.
+		{Terminated, Terminated, true},
+		{Failed, StandBy, false},
+		{Failed, Terminated, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			sm := newStatusMachine(tt.from)
+			err := sm.transition(tt.to)
+			if (err == nil) != tt.allowed {
+				t.Fatalf("transition() = %v, want allowed %t", err, tt.allowed)
+			}
+			want := tt.from
+			if tt.allowed {
+				want = tt.to
+			}
+			if sm.get() != want {
+				t.Fatalf("status is %s, want %s", sm.get(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package runner
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Xarepo/msc-container-migration/internal/env"
+)
+
+func TestMain(m *testing.M) {
+	// The local transport needs no SSH credentials.
+	os.Setenv("TRANSPORT", "local")
+	if err := env.Init(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
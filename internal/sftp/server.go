@@ -0,0 +1,416 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Xarepo/msc-container-migration/internal/codec"
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/env"
+)
+
+// Serve SFTP on the address until listening fails.
+//
+// The server only offers the SFTP subsystem, authenticates clients with the
+// cluster's SSH password or authorized keys and only allows dumps to be
+// written into the dump path, so the nodes need no system sshd nor OS users.
+func Serve(addr string) error {
+	config, err := serverConfig()
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to listen for dumps")
+	}
+	log.Debug().Str("Address", addr).Msg("Listening for dumps over SFTP")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return errors.Wrap(err, "Failed to accept connection")
+		}
+		go handleConn(conn, config)
+	}
+}
+
+func serverConfig() (*ssh.ServerConfig, error) {
+	config := &ssh.ServerConfig{}
+	if env.Getenv().SSH_PASSWORD != "" {
+		config.PasswordCallback = func(
+			conn ssh.ConnMetadata,
+			password []byte,
+		) (*ssh.Permissions, error) {
+			pass := subtle.ConstantTimeCompare(
+				password,
+				[]byte(env.Getenv().SSH_PASSWORD),
+			)
+			if !isUser(conn) || pass != 1 {
+				return nil, errors.Errorf("Invalid credentials for %s", conn.User())
+			}
+			return nil, nil
+		}
+	}
+	if file := env.Getenv().SSH_AUTHORIZED_KEYS; file != "" {
+		authorized, err := readAuthorizedKeys(file)
+		if err != nil {
+			return nil, err
+		}
+		config.PublicKeyCallback = func(
+			conn ssh.ConnMetadata,
+			key ssh.PublicKey,
+		) (*ssh.Permissions, error) {
+			if !isUser(conn) || !authorized[string(key.Marshal())] {
+				return nil, errors.Errorf("Unauthorized key for %s", conn.User())
+			}
+			return nil, nil
+		}
+	}
+
+	signer, err := HostKey()
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(signer)
+	return config, nil
+}
+
+// Return whether or not the connection is authenticating as the cluster's
+// user.
+func isUser(conn ssh.ConnMetadata) bool {
+	return subtle.ConstantTimeCompare(
+		[]byte(conn.User()),
+		[]byte(env.Getenv().SSH_USER),
+	) == 1
+}
+
+// Read the keys of an authorized_keys file.
+func readAuthorizedKeys(file string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read authorized keys")
+	}
+	keys := map[string]bool{}
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse authorized keys")
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+	return keys, nil
+}
+
+var hostKey struct {
+	once   sync.Once
+	signer ssh.Signer
+	err    error
+}
+
+// Return the host key of the server, which is loaded from SSH_HOST_KEY, or
+// generated if no file is given, the first time it is needed.
+func HostKey() (ssh.Signer, error) {
+	hostKey.once.Do(func() {
+		hostKey.signer, hostKey.err = loadHostKey(env.Getenv().SSH_HOST_KEY)
+	})
+	return hostKey.signer, hostKey.err
+}
+
+// Return the SHA256 fingerprint of the host key of the server, which other
+// nodes verify the server with, or an empty string if the host key could not
+// be loaded.
+func HostKeyFingerprint() string {
+	signer, err := HostKey()
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Failed to load host key")
+		return ""
+	}
+	return ssh.FingerprintSHA256(signer.PublicKey())
+}
+
+// Load the host key of the server from the file, or generate a new key if no
+// file is given.
+func loadHostKey(file string) (ssh.Signer, error) {
+	if file == "" {
+		log.Warn().Msg("SSH_HOST_KEY not set, generating a host key for this run")
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to generate host key")
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read host key")
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse host key")
+	}
+	return signer, nil
+}
+
+func handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Warn().
+			Str("Error", err.Error()).
+			Str("Remote", conn.RemoteAddr().String()).
+			Msg("SSH handshake failed")
+		return
+	}
+	defer sshConn.Close()
+	log.Trace().Str("Remote", sshConn.RemoteAddr().String()).Msg("Receiving dump")
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "Only sessions are supported")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			log.Warn().Str("Error", err.Error()).Msg("Failed to accept channel")
+			continue
+		}
+		go handleSession(ch, reqs)
+	}
+}
+
+// Serve SFTP on the session once the client requests the subsystem. Any other
+// request, e.g. for a shell, is refused.
+func handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		// The payload of a subsystem request is the length prefixed name
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 &&
+			string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		server := sftp.NewRequestServer(ch, handlers(env.Getenv().DUMP_PATH))
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Error().Str("Error", err.Error()).Msg("Failed to serve SFTP")
+		}
+		server.Close()
+		return
+	}
+}
+
+// dumpFS is the filesystem exposed over SFTP. Only the files in the root, the
+// dump path, may be written, and none may be read.
+type dumpFS struct {
+	root string
+}
+
+func handlers(root string) sftp.Handlers {
+	fs := &dumpFS{root: path.Clean(root)}
+	return sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+}
+
+// Return the path if it is the root or in it.
+//
+// The parent directory is resolved to its real path and checked again, so
+// that symlinks in the root may not lead out of it. The last element is not
+// resolved; files are opened without following it.
+func (fs *dumpFS) resolve(p string) (string, error) {
+	p = path.Clean(p)
+	if p == fs.root {
+		return p, nil
+	}
+	if !strings.HasPrefix(p, fs.root+"/") {
+		return "", errors.Errorf("%s is not in %s", p, fs.root)
+	}
+	root, err := filepath.EvalSymlinks(fs.root)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	if dir != root && !strings.HasPrefix(dir, root+"/") {
+		return "", errors.Errorf("%s is not in %s", p, fs.root)
+	}
+	return path.Join(dir, path.Base(p)), nil
+}
+
+func (fs *dumpFS) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	return nil, errors.New("Reading files is not supported")
+}
+
+func (fs *dumpFS) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	p, err := fs.resolve(req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | syscall.O_NOFOLLOW
+	if req.Pflags().Trunc {
+		// Replace, rather than truncate, the existing file, as it may be a
+		// hard link to the file of another dump.
+		os.Remove(p)
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(p, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Rename the file to dest, replacing dest. Files compressed by the client are
+// decompressed into dest, without the extension of the codec, and removed.
+func rename(file, dest string) error {
+	c := codec.FromFile(dest)
+	if c == nil {
+		return os.Rename(file, dest)
+	}
+	dest = strings.TrimSuffix(dest, c.Ext())
+
+	in, err := os.OpenFile(file, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := c.NewReader(in)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to decompress %s", file)
+	}
+	defer r.Close()
+	tmp := dest + ".tmp"
+	out, err := os.OpenFile(
+		tmp,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return errors.Wrapf(err, "Failed to decompress %s", file)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// Replace, rather than write to, dest, as it may be a hard link to the
+	// file of another dump.
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+func (fs *dumpFS) Filecmd(req *sftp.Request) error {
+	p, err := fs.resolve(req.Filepath)
+	if err != nil {
+		return err
+	}
+	switch req.Method {
+	case "Mkdir":
+		return os.Mkdir(p, 0755)
+	case "Setstat":
+		// Only the size is set, by clients truncating partially transferred
+		// files. Other attributes of received files are not preserved.
+		if !req.AttrFlags().Size {
+			return nil
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Truncate(int64(req.Attributes().Size))
+	case "Rename":
+		dest, err := fs.resolve(req.Target)
+		if err != nil {
+			return err
+		}
+		return rename(p, dest)
+	case "Symlink":
+		// The path is the target of the link, and Target the link itself. The
+		// link is created relative to the target, so that the dump path may be
+		// moved.
+		link, err := fs.resolve(req.Target)
+		if err != nil {
+			return err
+		}
+		rel, err := parentLink(p, link)
+		if err != nil {
+			return err
+		}
+		os.Remove(link)
+		return os.Symlink(rel, link)
+	default:
+		return errors.Errorf("%s is not supported", req.Method)
+	}
+}
+
+// Return the relative target of the link, if it is the parent symlink of a
+// dump to the dump before it. No other symlinks may be created.
+func parentLink(target, link string) (string, error) {
+	dumpDir := path.Dir(link)
+	if path.Base(link) != "parent" ||
+		!dump.IsDumpName(path.Base(dumpDir)) ||
+		!dump.IsDumpName(path.Base(target)) ||
+		path.Dir(target) != path.Dir(dumpDir) ||
+		target == dumpDir {
+		return "", errors.Errorf(
+			"Only parent symlinks of dumps are supported, not %s to %s",
+			link,
+			target,
+		)
+	}
+	return "../" + path.Base(target), nil
+}
+
+func (fs *dumpFS) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	p, err := fs.resolve(req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != "Stat" {
+		return nil, errors.Errorf("%s is not supported", req.Method)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{fi}, nil
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,146 @@
+package sftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestResolve(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	for _, dir := range []string{"d1", "d2"} {
+		if err := os.Mkdir(path.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Symlinks leading out of the root
+	if err := os.Symlink(outside, path.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../..", path.Join(root, "d1", "up")); err != nil {
+		t.Fatal(err)
+	}
+	// Symlinks within the root, like the parent symlinks of dumps
+	if err := os.Symlink("../d2", path.Join(root, "d1", "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &dumpFS{root: root}
+	tests := []struct {
+		path string
+		// The resolved path, empty if the path should be rejected.
+		want string
+	}{
+		{"", root},
+		{"/", root},
+		{"/d1/pages-1.img", root + "/d1/pages-1.img"},
+		{"/d1/../d2", root + "/d2"},
+		{"/./d1", root + "/d1"},
+		{"/d1/parent", root + "/d1/parent"},
+		{"/d1/parent/pages-1.img", root + "/d2/pages-1.img"},
+		{"/d3/pages-1.img", ""},
+		{"/escape", root + "/escape"},
+		{"/escape/passwd", ""},
+		{"/d1/up/passwd", ""},
+		{"/..", ""},
+		{"/../etc/passwd", ""},
+		{"/d1/../../etc", ""},
+		{"x/d1", ""},
+		{"2", ""},
+	}
+	for _, tt := range tests {
+		p := root + tt.path
+		t.Run(p, func(t *testing.T) {
+			got, err := fs.resolve(p)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("resolve(%q) = %q, want error", p, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve(%q) failed: %s", p, err)
+			}
+			if got != tt.want {
+				t.Fatalf("resolve(%q) = %q, want %q", p, got, tt.want)
+			}
+		})
+	}
+	for _, p := range []string{"/", "/etc/passwd", "dumps/d1", ""} {
+		if got, err := fs.resolve(p); err == nil {
+			t.Errorf("resolve(%q) = %q, want error", p, got)
+		}
+	}
+}
+
+func TestParentLink(t *testing.T) {
+	tests := []struct {
+		target, link string
+		// The relative target, empty if the link should be rejected.
+		want string
+	}{
+		{"/dumps/p0", "/dumps/d1/parent", "../p0"},
+		{"/dumps/d1", "/dumps/c2-0a/parent", "../d1"},
+		{"/dumps/d1", "/dumps/d1/parent", ""},
+		{"/dumps/p0", "/dumps/d1/pages-1.img", ""},
+		{"/dumps/etc", "/dumps/d1/parent", ""},
+		{"/dumps/p0", "/dumps/x/parent", ""},
+		{"/dumps/a/p0", "/dumps/d1/parent", ""},
+		{"/dumps/p0", "/dumps/a/d1/parent", ""},
+	}
+	for _, tt := range tests {
+		got, err := parentLink(tt.target, tt.link)
+		call := fmt.Sprintf("parentLink(%q, %q)", tt.target, tt.link)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s = %q, want error", call, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s failed: %s", call, err)
+		} else if got != tt.want {
+			t.Errorf("%s = %q, want %q", call, got, tt.want)
+		}
+	}
+}
+
+// Files are not written through symlinks planted in place of them.
+func TestWriteNoFollow(t *testing.T) {
+	root := t.TempDir()
+	victim := path.Join(t.TempDir(), "victim")
+	if err := ioutil.WriteFile(victim, []byte("victim"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := path.Join(root, "link")
+	if err := os.Symlink(victim, p); err != nil {
+		t.Fatal(err)
+	}
+	fs := &dumpFS{root: root}
+
+	if _, err := fs.Filewrite(sftp.NewRequest("Put", p)); err == nil {
+		t.Error("Opened a symlink for writing")
+	}
+	// Truncate the file to 0 bytes
+	setstat := sftp.NewRequest("Setstat", p)
+	setstat.Flags = 1
+	setstat.Attrs = make([]byte, 8)
+	if err := fs.Filecmd(setstat); err == nil {
+		t.Error("Truncated through a symlink")
+	}
+	if err := rename(p, path.Join(root, "dest.zst")); err == nil {
+		t.Error("Decompressed a symlink")
+	}
+	if b, err := ioutil.ReadFile(victim); err != nil || string(b) != "victim" {
+		t.Fatalf("Victim was modified: %q, %v", b, err)
+	}
+}
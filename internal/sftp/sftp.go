@@ -1,20 +1,30 @@
 package sftp
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 
 	chain_node "github.com/Xarepo/msc-container-migration/internal/chain/node"
+	"github.com/Xarepo/msc-container-migration/internal/codec"
 	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
 	"github.com/Xarepo/msc-container-migration/internal/remote_target"
 )
 
@@ -27,43 +37,182 @@ func isSymlink(fileName string) bool {
 	return fileInfo.Mode()&os.ModeSymlink != 0
 }
 
+// SFTPTransport transfers dumps over SFTP, authenticating with the SSH
+// credentials from the environment and verifying the host key of the target.
+// Dumps are received by the SFTP server of the system itself.
+type SFTPTransport struct{}
+
+func (t *SFTPTransport) TransferDump(
+	node *chain_node.ChainNode,
+	target *remote_target.RemoteTarget,
+) error {
+	return TransferDump(node, target)
+}
+
+func (t *SFTPTransport) Receive(addr string) error {
+	return Serve(addr)
+}
+
+// Transfer the dump of the node to the target. Files are written under
+// temporary names, and renamed once they are complete. If the transfer fails,
+// the next transfer of the dump to the target resumes each file from the last
+// offset the target confirmed.
 func TransferDump(
 	node *chain_node.ChainNode,
 	target *remote_target.RemoteTarget,
-) {
+) error {
+	if err := CheckCredentials(); err != nil {
+		return err
+	}
 	user := env.Getenv().SSH_USER
-	password := env.Getenv().SSH_PASSWORD
 	log.Debug().
 		Str("User", user).
-		Str("Password", password).
 		Str("RemotePath", target.DumpPath).
 		Str("Dump Name", node.Dump().Base()).
 		Str("Target", target.Host).
 		Msg("Copying to remote")
 
+	// Collect files
+	files, err := filepath.Glob(fmt.Sprintf("%s/*", node.Dump().Path()))
+	if err != nil {
+		log.Error().Msg("Failed to collect files for transfer")
+		return errors.Wrap(err, "Failed to collect files for transfer")
+	}
+
+	c, err := codec.New(target.Codec)
+	if err != nil {
+		return err
+	}
+	stats := codec.Stats{Codec: c.Name()}
+	start := time.Now()
+
+	key := progressKey(node, target)
+	p := loadProgress(key)
+	err = transferFiles(files, node, target, c, &stats, p)
+	storeProgress(key, p, err)
+	if err != nil {
+		log.Warn().
+			Str("Error", err.Error()).
+			Str("Dump Name", node.Dump().Base()).
+			Msg("Failed to transfer dump, chain is likely corrupt")
+		return err
+	}
+	stats.Log(node.Dump().Base(), target.Id(), time.Since(start))
+	return nil
+}
+
+// The progress of a transfer, kept across attempts.
+type progress struct {
+	// The number of bytes of each partially transferred file that the target
+	// has confirmed, by file name.
+	offsets map[string]int64
+	// The names of the files that have been transferred.
+	done map[string]bool
+	// When the transfer last failed.
+	failed time.Time
+}
+
+// The progress of the transfers that failed, by progressKey, to be resumed by
+// the next transfer of the dump to the target.
+var (
+	progresses   = map[string]*progress{}
+	progressLock sync.Mutex
+)
+
+// The time the progress of a failed transfer is kept, if the dump is not
+// transferred to the target again, e.g. because the target left the cluster.
+const _PROGRESS_TTL = time.Hour
+
+// Return the key of the progress of transferring the dump to the target.
+//
+// Dumps are identified by their name and the digest of their manifest, as the
+// dumps staged for deduplicated transfers are staged in a new directory on
+// every attempt, and their packs differ if other chunks are missing on the
+// target.
+func progressKey(
+	node *chain_node.ChainNode,
+	target *remote_target.RemoteTarget,
+) string {
+	key := target.Id() + ":" + node.Dump().Base() + ":"
+	manifestPath := path.Join(node.Dump().Path(), manifest.FILE_NAME)
+	content, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return key
+	}
+	digest := sha256.Sum256(content)
+	return key + hex.EncodeToString(digest[:])
+}
+
+// Return the progress of the previous, failed, transfer under the key, or a
+// new progress if there is none.
+func loadProgress(key string) *progress {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	if p, ok := progresses[key]; ok {
+		return p
+	}
+	return &progress{offsets: map[string]int64{}, done: map[string]bool{}}
+}
+
+// Keep the progress of the transfer under the key if it failed, and forget it
+// otherwise.
+// The progress of other transfers of the dump to the target, e.g. of a pack
+// that has since changed, can never be resumed and is forgotten, as is the
+// progress of transfers that failed too long ago.
+func storeProgress(key string, p *progress, err error) {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	prefix := key[:strings.LastIndex(key, ":")+1]
+	for k, other := range progresses {
+		if strings.HasPrefix(k, prefix) || time.Since(other.failed) > _PROGRESS_TTL {
+			delete(progresses, k)
+		}
+	}
+	if err != nil {
+		p.failed = time.Now()
+		progresses[key] = p
+	}
+}
+
+// The time to wait for the SSH connection to the target to be established.
+const _DIAL_TIMEOUT = 10 * time.Second
+
+// Connect to the target and transfer the files that are not done.
+func transferFiles(
+	files []string,
+	node *chain_node.ChainNode,
+	target *remote_target.RemoteTarget,
+	c codec.Codec,
+	stats *codec.Stats,
+	p *progress,
+) error {
+	auth, closeAuth, err := authMethods()
+	if err != nil {
+		return err
+	}
+	defer closeAuth()
+	hostKeyCallback, err := hostKeyCallback(target)
+	if err != nil {
+		return err
+	}
 	clientConfig := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: func(
-			hostname string,
-			remote net.Addr,
-			key ssh.PublicKey,
-		) error {
-			return nil
-		},
+		User:            env.Getenv().SSH_USER,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         _DIAL_TIMEOUT,
 	}
 
 	sshClient, err := ssh.Dial("tcp", target.FileTransferAddr(), clientConfig)
 	if err != nil {
 		log.Error().Str("Error", err.Error()).Msg("Failed to dial ssh")
+		return errors.Wrap(err, "Failed to dial ssh")
 	}
+	defer sshClient.Close()
 
 	sftpClient, err := sftp.NewClient(sshClient)
 	if err != nil {
 		log.Error().Str("Error", err.Error()).Msg("Failed to create sftp client")
-		return
+		return errors.Wrap(err, "Failed to create sftp client")
 	}
 	defer sftpClient.Close()
 
@@ -76,64 +225,242 @@ func TransferDump(
 			Str("Error", err.Error()).
 			Str("DumpDir", destDir).
 			Msg("Failed to create dump directory on remote")
-		return
-	}
-
-	// Collect files
-	files, err := filepath.Glob(fmt.Sprintf("%s/*", node.Dump().Path()))
-	if err != nil {
-		log.Error().Msg("Failed to collect files for transfer")
+		return errors.Wrap(err, "Failed to create dump directory on remote")
 	}
 
 	// Copy files to remote
 	for _, file := range files {
-		err := transferFile(&file, &destDir, node, sftpClient)
+		name := filepath.Base(file)
+		if p.done[name] {
+			continue
+		}
+		err := transferFile(&file, &destDir, node, sftpClient, c, stats, p)
 		if err != nil {
-			log.Warn().
-				Str("File", file).
-				Str("Error", err.Error()).
-				Msg("Failed to transfer file, chain is likely corrupt")
+			return errors.Wrapf(err, "Failed to transfer %s", name)
 		}
+		p.done[name] = true
+		delete(p.offsets, name)
 	}
+	return nil
 }
 
+// Check that the credentials to transfer dumps over SFTP are set.
+func CheckCredentials() error {
+	e := env.Getenv()
+	if e.SSH_USER == "" {
+		return errors.New("SSH_USER must be set to transfer dumps over SFTP")
+	}
+	if e.SSH_PASSWORD == "" && e.SSH_KEY == "" && e.SSH_AUTH_SOCK == "" {
+		return errors.New(
+			"One of SSH_PASSWORD, SSH_KEY and SSH_AUTH_SOCK must be set" +
+				" to transfer dumps over SFTP",
+		)
+	}
+	return nil
+}
+
+// Return the methods to authenticate with, in order of preference: the key
+// file, the keys of the SSH agent and the password. The returned function
+// closes the connection to the agent.
+func authMethods() ([]ssh.AuthMethod, func(), error) {
+	methods := []ssh.AuthMethod{}
+	closeAuth := func() {}
+	if file := env.Getenv().SSH_KEY; file != "" {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to read SSH key")
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to parse SSH key")
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if sock := env.Getenv().SSH_AUTH_SOCK; sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to connect to SSH agent")
+		}
+		closeAuth = func() { conn.Close() }
+		methods = append(
+			methods,
+			ssh.PublicKeysCallback(agent.NewClient(conn).Signers),
+		)
+	}
+	if password := env.Getenv().SSH_PASSWORD; password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods, closeAuth, nil
+}
+
+// Return the callback verifying the host key of the target.
+//
+// The key must match the fingerprint the target advertised when joining the
+// cluster. Targets that did not advertise a fingerprint are verified with the
+// known hosts file, and refused if there is none.
+func hostKeyCallback(
+	target *remote_target.RemoteTarget,
+) (ssh.HostKeyCallback, error) {
+	if target.HostKey != "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fingerprint := ssh.FingerprintSHA256(key)
+			if fingerprint != target.HostKey {
+				return errors.Errorf(
+					"Host key %s of %s does not match %s",
+					fingerprint,
+					hostname,
+					target.HostKey,
+				)
+			}
+			return nil
+		}, nil
+	}
+	if file := env.Getenv().SSH_KNOWN_HOSTS; file != "" {
+		callback, err := knownhosts.New(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read known hosts")
+		}
+		return callback, nil
+	}
+	return nil, errors.Errorf(
+		"No host key known for %s, and SSH_KNOWN_HOSTS is not set",
+		target.Id(),
+	)
+}
+
+// Transfer the file, compressed with the codec, resuming it from the offset
+// in the progress. Compressed files are written with the extension of the
+// codec, and decompressed by the server once they are renamed from their
+// temporary name.
 func transferFile(
 	file, destDir *string,
 	node *chain_node.ChainNode,
 	sftpClient *sftp.Client,
+	c codec.Codec,
+	stats *codec.Stats,
+	p *progress,
 ) error {
 	log.Trace().Str("File", *file).Msg("Transferring file")
 
 	// Copy parent symlinks.
 	// The only occurring symlinks in the dump directories should be the symlink
-	// to the parent directory.
+	// to the parent directory. The server only accepts absolute paths, and
+	// makes the link relative again.
 	if isSymlink(*file) {
-		oldName := node.GetPrev().Dump().ParentPath()
+		oldName := path.Join(*destDir, node.GetPrev().Dump().ParentPath())
+		newName := path.Join(*destDir, filepath.Base(*file))
 		log.Trace().
 			Str("OldName", oldName).
-			Str("NewName", *file).
+			Str("NewName", newName).
 			Msg("Creating parent symlink")
-		err := sftpClient.Symlink(oldName, *file)
+		err := sftpClient.Symlink(oldName, newName)
 		if err != nil {
 			return errors.Wrap(err, "Failed to create parent symlink")
 		}
 		return nil
 	}
 
-	dstFile, err := sftpClient.Create(path.Join(*destDir, filepath.Base(*file)))
+	f, err := os.Open(*file)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open file")
+	}
+	defer f.Close()
+
+	name := filepath.Base(*file)
+	dest := path.Join(*destDir, name+c.Ext())
+	part := dest + _PART_EXT
+	offset := p.offsets[name]
+	// Start over if the partial file is gone or shorter than confirmed, e.g. if
+	// it was renamed but the reply was lost.
+	if fi, err := sftpClient.Stat(part); err != nil || fi.Size() < offset {
+		offset = 0
+	}
+	dstFile, err := sftpClient.OpenFile(part, os.O_WRONLY|os.O_CREATE)
 	if err != nil {
 		return errors.Wrap(err, "Failed to create remote file")
 	}
 	defer dstFile.Close()
+	if err := sftpClient.Truncate(part, offset); err != nil {
+		return errors.Wrap(err, "Failed to truncate remote file")
+	}
+	if _, err := dstFile.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrap(err, "Failed to seek remote file")
+	}
+	if offset > 0 {
+		log.Debug().
+			Str("File", *file).
+			Int64("Offset", offset).
+			Msg("Resuming transfer of file")
+	}
 
-	f, err := os.Open(*file)
+	// The compressed file is the same on every attempt, so the bytes already
+	// written are compressed again, and skipped.
+	// Only the stats of the attempt that completes the file are counted.
+	p.offsets[name] = offset
+	rw := &resumeWriter{w: dstFile, skip: offset, offset: offset, p: p, file: name}
+	fileStats := codec.Stats{Codec: c.Name()}
+	w, err := fileStats.NewWriter(c, rw)
 	if err != nil {
-		return errors.Wrap(err, "Failed to open file")
+		return err
 	}
-	_, err = io.Copy(dstFile, f)
-	if err != nil {
+	if _, err := io.Copy(w, f); err != nil {
 		return errors.Wrap(err, "Failed to write remote file")
 	}
-
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "Failed to write remote file")
+	}
+	if err := dstFile.Close(); err != nil {
+		return errors.Wrap(err, "Failed to close remote file")
+	}
+	// The server decompresses the file when it is renamed
+	if err := sftpClient.Rename(part, dest); err != nil {
+		return errors.Wrap(err, "Failed to rename remote file")
+	}
+	stats.Raw += fileStats.Raw
+	stats.Compressed += fileStats.Compressed
+	stats.Elapsed += fileStats.Elapsed
 	return nil
 }
+
+// The extension of files that are being transferred.
+const _PART_EXT = ".part"
+
+// The size of the writes to remote files. Each write fits in a single SFTP
+// packet, so that a failed write leaves everything before it confirmed.
+const _WRITE_SIZE = 32 << 10
+
+// resumeWriter skips the bytes that have already been written to the remote
+// file, and records the offset of every confirmed write in the progress.
+type resumeWriter struct {
+	w      io.Writer
+	skip   int64
+	offset int64
+	p      *progress
+	file   string
+}
+
+func (rw *resumeWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	if rw.skip > 0 {
+		k := int64(len(b))
+		if k > rw.skip {
+			k = rw.skip
+		}
+		rw.skip -= k
+		b = b[k:]
+	}
+	for len(b) > 0 {
+		size := len(b)
+		if size > _WRITE_SIZE {
+			size = _WRITE_SIZE
+		}
+		m, err := rw.w.Write(b[:size])
+		rw.offset += int64(m)
+		rw.p.offsets[rw.file] = rw.offset
+		if err != nil {
+			return 0, err
+		}
+		b = b[size:]
+	}
+	return n, nil
+}
@@ -0,0 +1,71 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	chain_node "github.com/Xarepo/msc-container-migration/internal/chain/node"
+	"github.com/Xarepo/msc-container-migration/internal/dump"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+)
+
+// Stage the dump with the pack in a new directory, as deduplicated transfers
+// do on every attempt.
+func stageDump(t *testing.T, pack string) *chain_node.ChainNode {
+	d := dump.Dir(t.TempDir()).FromString("d1")
+	if err := os.MkdirAll(d.Path(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(d.Path(), "pack")
+	if err := ioutil.WriteFile(file, []byte(pack), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Write(d.Path()); err != nil {
+		t.Fatal(err)
+	}
+	return chain_node.New(d, nil)
+}
+
+func TestProgressKey(t *testing.T) {
+	target := &remote_target.RemoteTarget{Host: "10.0.0.2", RPCPort: 1234}
+	k1 := progressKey(stageDump(t, "chunks"), target)
+	k2 := progressKey(stageDump(t, "chunks"), target)
+	if k1 != k2 {
+		t.Fatalf("Keys of the same staged dump differ: %s, %s", k1, k2)
+	}
+	if k3 := progressKey(stageDump(t, "other chunks"), target); k3 == k1 {
+		t.Fatal("Keys of dumps with different packs are equal")
+	}
+}
+
+func TestStoreProgress(t *testing.T) {
+	defer func() { progresses = map[string]*progress{} }()
+	failed := errors.New("Connection lost")
+
+	p := loadProgress("t:d1:a")
+	p.offsets["pack"] = 10
+	storeProgress("t:d1:a", p, failed)
+	if loadProgress("t:d1:a").offsets["pack"] != 10 {
+		t.Fatal("Progress of failed transfer was not kept")
+	}
+
+	// The pack changed, so the previous progress can never be resumed
+	storeProgress("t:d1:b", loadProgress("t:d1:b"), failed)
+	if _, ok := progresses["t:d1:a"]; ok {
+		t.Fatal("Progress of the previous pack was kept")
+	}
+
+	// Transfers that failed long ago are forgotten
+	storeProgress("t:d2:a", loadProgress("t:d2:a"), failed)
+	progresses["t:d2:a"].failed = time.Now().Add(-2 * _PROGRESS_TTL)
+	storeProgress("t:d1:b", loadProgress("t:d1:b"), nil)
+	if len(progresses) != 0 {
+		t.Fatalf("Progresses not forgotten: %v", progresses)
+	}
+}
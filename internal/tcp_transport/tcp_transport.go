@@ -0,0 +1,298 @@
+// Package tcp_transport transfers dumps as tar streams over plain TCP.
+//
+// Every connection carries a single dump. The dump directory of the target,
+// which must be in the receiver's dump path, is sent on the first line and the
+// codec agreed with the target on the second, followed by the tar stream of
+// the dump compressed with the codec.
+//
+// There is no authentication nor encryption, so the transport should only be
+// used on trusted networks.
+package tcp_transport
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	chain_node "github.com/Xarepo/msc-container-migration/internal/chain/node"
+	"github.com/Xarepo/msc-container-migration/internal/codec"
+	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/manifest"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+)
+
+// Replies written by the receiver once a dump has been received.
+const (
+	_REPLY_OK    = "OK"
+	_REPLY_ERROR = "ERROR"
+)
+
+type TCPTransport struct{}
+
+// The time to wait for the connection to the target to be established.
+const _DIAL_TIMEOUT = 10 * time.Second
+
+// Stream the dump directory of the node to the target as a tar archive.
+// Blocks until the target has replied that it has written the dump. A failed
+// transfer is streamed again, whole, by the next transfer of the dump.
+func (t *TCPTransport) TransferDump(
+	node *chain_node.ChainNode,
+	target *remote_target.RemoteTarget,
+) error {
+	log.Debug().
+		Str("Dump Name", node.Dump().Base()).
+		Str("Target", target.FileTransferAddr()).
+		Msg("Streaming dump to remote")
+
+	c, err := codec.New(target.Codec)
+	if err != nil {
+		return err
+	}
+	stats := codec.Stats{Codec: c.Name()}
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", target.FileTransferAddr(), _DIAL_TIMEOUT)
+	if err != nil {
+		return errors.Wrap(err, "Failed to dial file transfer address")
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintf(conn, "%s\n%s\n", target.DumpPath, c.Name()); err != nil {
+		return errors.Wrap(err, "Failed to write dump directory")
+	}
+	w, err := stats.NewWriter(c, conn)
+	if err != nil {
+		return err
+	}
+	if err := writeDump(w, node.Dump().Path()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "Failed to write dump")
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.CloseWrite(); err != nil {
+			return errors.Wrap(err, "Failed to close write side of connection")
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "Failed to read reply from remote")
+	}
+	reply = strings.TrimSpace(reply)
+	if reply != _REPLY_OK {
+		return errors.Errorf("Remote failed to receive dump: %s", reply)
+	}
+	stats.Log(node.Dump().Base(), target.Id(), time.Since(start))
+	return nil
+}
+
+// Listen for dumps on the given address and write them to the dump path.
+func (t *TCPTransport) Receive(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to listen for dumps")
+	}
+	log.Debug().Str("Address", addr).Msg("Listening for dumps over TCP")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return errors.Wrap(err, "Failed to accept connection")
+		}
+		go handleConn(conn)
+	}
+}
+
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+	log.Trace().Str("Remote", conn.RemoteAddr().String()).Msg("Receiving dump")
+
+	r := bufio.NewReader(conn)
+	dir, err := readDumpDir(r)
+	if err == nil {
+		err = readCompressedDump(r, dir)
+	}
+	if err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Str("Remote", conn.RemoteAddr().String()).
+			Msg("Failed to receive dump")
+		fmt.Fprintf(conn, "%s %s\n", _REPLY_ERROR, err.Error())
+		return
+	}
+	fmt.Fprintf(conn, "%s\n", _REPLY_OK)
+}
+
+// Read the directory to write the dump to, which must be the dump path or a
+// directory in it.
+func readDumpDir(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read dump directory")
+	}
+	dir := path.Clean(strings.TrimSpace(line))
+	root := path.Clean(env.Getenv().DUMP_PATH)
+	if dir != root && !strings.HasPrefix(dir, root+"/") {
+		return "", errors.Errorf("Dump directory %s is not in %s", dir, root)
+	}
+	return dir, nil
+}
+
+// Read the codec of the dump, and the dump decompressed with it.
+func readCompressedDump(r *bufio.Reader, dir string) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "Failed to read codec")
+	}
+	c, err := codec.New(strings.TrimSpace(line))
+	if err != nil {
+		return err
+	}
+	cr, err := c.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "Failed to decompress dump")
+	}
+	defer cr.Close()
+	return readDump(cr, dir)
+}
+
+// Write the dump directory as a tar archive, with every entry prefixed by the
+// name of the dump directory.
+func writeDump(w io.Writer, dumpPath string) error {
+	files, err := filepath.Glob(fmt.Sprintf("%s/*", dumpPath))
+	if err != nil {
+		return errors.Wrap(err, "Failed to collect files for transfer")
+	}
+
+	tw := tar.NewWriter(w)
+	for _, file := range files {
+		if err := writeFile(tw, file, path.Base(dumpPath)); err != nil {
+			return errors.Wrapf(err, "Failed to transfer file %s", file)
+		}
+	}
+	return tw.Close()
+}
+
+func writeFile(tw *tar.Writer, file, dumpName string) error {
+	log.Trace().Str("File", file).Msg("Transferring file")
+
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = path.Join(dumpName, fi.Name())
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Read a tar archive written by writeDump into the dump path, and verify the
+// received dump against its manifest.
+func readDump(r io.Reader, dumpPath string) error {
+	tr := tar.NewReader(r)
+	dumpName := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if dumpName == "" {
+				return errors.New("Received empty dump")
+			}
+			return manifest.Verify(path.Join(dumpPath, dumpName))
+		}
+		if err != nil {
+			return errors.Wrap(err, "Failed to read archive")
+		}
+
+		// Only allow entries of the form <dump>/<file>, to not write outside of
+		// the dump path.
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || strings.Count(name, "/") != 1 ||
+			strings.HasPrefix(name, "..") {
+			return errors.Errorf("Invalid file name %s", hdr.Name)
+		}
+		if dumpName == "" {
+			dumpName = path.Dir(name)
+		} else if dumpName != path.Dir(name) {
+			return errors.Errorf("File %s is not part of dump %s", name, dumpName)
+		}
+		dest := path.Join(dumpPath, name)
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			return errors.Wrap(err, "Failed to create dump directory")
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			log.Trace().
+				Str("OldName", hdr.Linkname).
+				Str("NewName", dest).
+				Msg("Creating parent symlink")
+			os.Remove(dest)
+			if err := os.Symlink(hdr.Linkname, dest); err != nil {
+				return errors.Wrap(err, "Failed to create parent symlink")
+			}
+		case tar.TypeReg:
+			log.Trace().Str("File", dest).Msg("Receiving file")
+			if err := writeReceivedFile(tr, dest, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("Unsupported file type of %s", hdr.Name)
+		}
+	}
+}
+
+// Write the file to a temporary file, which then replaces any existing file
+// rather than writing to it, as it may be a hard link to the file of another
+// dump. Interrupted streams never leave partially written files behind.
+func writeReceivedFile(r io.Reader, dest string, mode os.FileMode) error {
+	part := dest + ".part"
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create file")
+	}
+	defer os.Remove(part)
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return errors.Wrap(err, "Failed to write file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "Failed to write file")
+	}
+	if err := os.Rename(part, dest); err != nil {
+		return errors.Wrap(err, "Failed to rename file")
+	}
+	return nil
+}
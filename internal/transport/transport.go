@@ -0,0 +1,85 @@
+// Package transport provides the interface used to move dumps between nodes,
+// and a way of selecting an implementation of it by name.
+package transport
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	chain_node "github.com/Xarepo/msc-container-migration/internal/chain/node"
+	"github.com/Xarepo/msc-container-migration/internal/local_transport"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+	"github.com/Xarepo/msc-container-migration/internal/sftp"
+	"github.com/Xarepo/msc-container-migration/internal/tcp_transport"
+)
+
+// Transport moves dump directories from the local node to a remote target.
+type Transport interface {
+	// Transfer the dump of a chain node to the target.
+	TransferDump(
+		node *chain_node.ChainNode,
+		target *remote_target.RemoteTarget,
+	) error
+	// Receive dumps from other nodes on the given address, of the form
+	// "ip:port". Blocks for as long as dumps are being received.
+	// Implementations that rely on external services to receive dumps (e.g. a
+	// system sshd) return immediately.
+	Receive(addr string) error
+}
+
+// Available transports
+const (
+	SFTP  = "sftp"
+	TCP   = "tcp"
+	Local = "local"
+)
+
+// TransferError is the error of transferring a dump to a target. The dump is
+// not synced to the target.
+type TransferError struct {
+	Dump   string
+	Target string
+	Err    error
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("Failed to transfer dump %s to %s: %s", e.Dump, e.Target, e.Err)
+}
+
+func (e *TransferError) Cause() error  { return e.Err }
+func (e *TransferError) Unwrap() error { return e.Err }
+
+// Return the transport with the given name.
+// An empty name selects the SFTP transport, which was the only transport
+// available before transports became selectable.
+func New(name string) (Transport, error) {
+	switch name {
+	case SFTP, "":
+		return &sftp.SFTPTransport{}, nil
+	case TCP:
+		return &tcp_transport.TCPTransport{}, nil
+	case Local:
+		return &local_transport.LocalTransport{}, nil
+	default:
+		return nil, errors.Errorf("Unknown transport %s", name)
+	}
+}
+
+// Check that dumps can be transferred to the target, i.e. that its transport
+// is known and that the credentials it needs are set.
+func CheckTarget(target *remote_target.RemoteTarget) error {
+	switch target.Transport {
+	case SFTP, "":
+		return sftp.CheckCredentials()
+	case TCP, Local:
+		return nil
+	default:
+		return errors.Errorf("Unknown transport %s", target.Transport)
+	}
+}
+
+// Return the transport the target receives dumps with.
+func FromTarget(target *remote_target.RemoteTarget) (Transport, error) {
+	return New(target.Transport)
+}
@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Xarepo/msc-container-migration/internal/env"
+	"github.com/Xarepo/msc-container-migration/internal/remote_target"
+)
+
+func TestCheckTarget(t *testing.T) {
+	// The node receives dumps over TCP, so no SSH credentials are required to
+	// start it.
+	os.Setenv("TRANSPORT", TCP)
+	os.Unsetenv("SSH_USER")
+	os.Unsetenv("SSH_PASSWORD")
+	defer os.Unsetenv("TRANSPORT")
+	if err := env.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		transport string
+		ok        bool
+	}{
+		{TCP, true},
+		{Local, true},
+		{SFTP, false},
+		{"", false},
+		{"ftp", false},
+	}
+	for _, c := range cases {
+		target := remote_target.RemoteTarget{Transport: c.transport}
+		if err := CheckTarget(&target); (err == nil) != c.ok {
+			t.Errorf("CheckTarget(%q) = %v, want ok %v", c.transport, err, c.ok)
+		}
+	}
+
+	// With credentials, targets receiving dumps over SFTP may join.
+	os.Setenv("SSH_USER", "msc")
+	os.Setenv("SSH_PASSWORD", "secret")
+	defer os.Unsetenv("SSH_USER")
+	defer os.Unsetenv("SSH_PASSWORD")
+	if err := env.Init(); err != nil {
+		t.Fatal(err)
+	}
+	target := remote_target.RemoteTarget{Transport: SFTP}
+	if err := CheckTarget(&target); err != nil {
+		t.Errorf("CheckTarget(%q) = %v, want ok", SFTP, err)
+	}
+}
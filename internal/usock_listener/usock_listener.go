@@ -1,48 +1,221 @@
 package usock_listener
 
 import (
+	"bufio"
+	"fmt"
 	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+
+	"github.com/Xarepo/msc-container-migration/internal/env"
 )
 
-type USockListener struct{}
+// The suffix of the control socket's path, on which the CLI sends requests to
+// the runner. The control socket is placed next to the IPC socket.
+const _CONTROL_SUFFIX = ".ctl.sock"
+
+// The name of the control socket of the daemon, in the socket directory.
+const _DAEMON_SOCK_NAME = "daemon.ctl"
+
+// Return the path of the control socket of the daemon.
+func DaemonAddr() string {
+	return path.Join(env.Getenv().SOCKET_DIR, _DAEMON_SOCK_NAME)
+}
+
+// Return the default path of the IPC socket of the runner of the container.
+func SockAddr(containerId string) string {
+	return path.Join(env.Getenv().SOCKET_DIR, fmt.Sprintf("%s.sock", containerId))
+}
+
+// Return the path of the control socket belonging to the IPC socket.
+func ControlAddr(sockAddr string) string {
+	return strings.TrimSuffix(sockAddr, ".sock") + _CONTROL_SUFFIX
+}
+
+// Find the control socket of a runner on this host.
+//
+// The runner is selected by the path of its IPC socket if given, else by the
+// id of its container. If neither is given the runner is found in the socket
+// directory, which is only possible if there is exactly one runner.
+func FindControlAddr(containerId, sockAddr string) (string, error) {
+	if sockAddr != "" {
+		return ControlAddr(sockAddr), nil
+	}
+	if containerId != "" {
+		return ControlAddr(SockAddr(containerId)), nil
+	}
+
+	dir := env.Getenv().SOCKET_DIR
+	found, err := filepath.Glob(path.Join(dir, "*"+_CONTROL_SUFFIX))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to search for runners")
+	}
+	switch len(found) {
+	case 0:
+		return "", errors.Errorf("Found no runner in %s", dir)
+	case 1:
+		return found[0], nil
+	default:
+		ids := []string{}
+		for _, addr := range found {
+			ids = append(ids, strings.TrimSuffix(path.Base(addr), _CONTROL_SUFFIX))
+		}
+		return "", errors.Errorf(
+			"Found several runners (%s), select one by container id or socket",
+			strings.Join(ids, ", "),
+		)
+	}
+}
 
-const SOCK_ADDR = "/tmp/msc.sock"
+// Prepare the socket path for listening, by removing any stale socket left by
+// an earlier runner.
+// Returns an error if another runner is still listening on the socket.
+func claimSocket(network, sockAddr string) error {
+	if err := os.MkdirAll(path.Dir(sockAddr), 0755); err != nil {
+		return errors.Wrap(err, "Failed to create socket directory")
+	}
+	if c, err := net.Dial(network, sockAddr); err == nil {
+		c.Close()
+		return errors.Errorf("Socket %s is in use by another runner", sockAddr)
+	}
 
-func (usock *USockListener) Listen(callback func(buf []byte)) {
-	var err error
-	log.Trace().Str("SocketAddress", SOCK_ADDR).Msg("Clearing socket")
-	if err := os.RemoveAll(SOCK_ADDR); err != nil {
-		log.Error().Str("SocketAddress", SOCK_ADDR).Msg("Failed to clear socket")
-	} else {
-		log.Trace().Str("SocketAddress", SOCK_ADDR).Msg("Socket cleared")
+	log.Trace().Str("SocketAddress", sockAddr).Msg("Clearing socket")
+	if err := os.RemoveAll(sockAddr); err != nil {
+		return errors.Wrap(err, "Failed to clear socket")
 	}
+	log.Trace().Str("SocketAddress", sockAddr).Msg("Socket cleared")
+	return nil
+}
+
+// USockListener listens for IPCs on a unix datagram socket. Messages are
+// one-way, so the responses of the handler are discarded.
+type USockListener struct {
+	lock sync.Mutex
+	conn *net.UnixConn
+	addr string
+	// Messages currently being handled.
+	handling sync.WaitGroup
+}
 
+func (usock *USockListener) Listen(
+	sockAddr string,
+	handler func(buf []byte) []byte,
+) error {
+	if err := claimSocket("unixgram", sockAddr); err != nil {
+		return err
+	}
 	conn, err := net.ListenUnixgram(
 		"unixgram",
 		&net.UnixAddr{
-			Name: SOCK_ADDR,
+			Name: sockAddr,
 			Net:  "unixgram",
 		},
 	)
 	if err != nil {
-		log.Error().Msgf("Failed to listen: %s", err)
+		return errors.Wrap(err, "Failed to listen")
 	}
+	usock.lock.Lock()
+	usock.conn = conn
+	usock.addr = sockAddr
+	usock.lock.Unlock()
 	log.Debug().
-		Str("Address", SOCK_ADDR).
+		Str("Address", sockAddr).
 		Msg("Listening for IPC messages on socket")
 
 	for {
 		var buf [1024]byte
 		nr, err := conn.Read(buf[:])
 		if err != nil {
-			panic(err)
+			log.Debug().Str("Error", err.Error()).Msg("Stopped listening on socket")
+			return nil
 		}
 		data := buf[0:nr]
 		log.Info().Str("Command", string(data)).Msg("Received command")
 
-		callback(data)
+		usock.handling.Add(1)
+		handler(data)
+		usock.handling.Done()
+	}
+}
+
+// Stop listening, which also removes the socket.
+func (usock *USockListener) Close() {
+	usock.lock.Lock()
+	if usock.conn != nil {
+		usock.conn.Close()
+		os.Remove(usock.addr)
+	}
+	usock.lock.Unlock()
+	usock.handling.Wait()
+}
+
+// USockStreamListener listens for requests on a unix stream socket. Every
+// connection carries a single request line, which is answered with the
+// response of the handler on a single line.
+type USockStreamListener struct {
+	lock     sync.Mutex
+	listener net.Listener
+	// Requests currently being handled.
+	handling sync.WaitGroup
+}
+
+func (usock *USockStreamListener) Listen(
+	sockAddr string,
+	handler func(buf []byte) []byte,
+) error {
+	if err := claimSocket("unix", sockAddr); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", sockAddr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to listen")
+	}
+	usock.lock.Lock()
+	usock.listener = l
+	usock.lock.Unlock()
+	log.Debug().
+		Str("Address", sockAddr).
+		Msg("Listening for IPC requests on socket")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Debug().Str("Error", err.Error()).Msg("Stopped listening on socket")
+			return nil
+		}
+		usock.handling.Add(1)
+		go func() {
+			defer usock.handling.Done()
+			handleConn(conn, handler)
+		}()
+	}
+}
+
+func handleConn(conn net.Conn, handler func(buf []byte) []byte) {
+	defer conn.Close()
+	data, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Failed to read request")
+		return
+	}
+	res := handler(data)
+	if _, err := conn.Write(append(res, '\n')); err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Failed to write response")
+	}
+}
+
+// Stop listening, which also removes the socket.
+func (usock *USockStreamListener) Close() {
+	usock.lock.Lock()
+	if usock.listener != nil {
+		usock.listener.Close()
 	}
+	usock.lock.Unlock()
+	usock.handling.Wait()
 }
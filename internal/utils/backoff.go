@@ -0,0 +1,54 @@
+package utils
+
+import "time"
+
+// Backoff tracks, by key, the consecutive failures of an operation that is
+// retried, and when it may be attempted again. The delay doubles with every
+// consecutive failure, starting at the base delay and capped at the maximum.
+//
+// Backoff is not safe for concurrent use.
+type Backoff struct {
+	base, max time.Duration
+	failures  map[string]int
+	next      map[string]time.Time
+}
+
+func NewBackoff(base, max time.Duration) *Backoff {
+	return &Backoff{
+		base:     base,
+		max:      max,
+		failures: map[string]int{},
+		next:     map[string]time.Time{},
+	}
+}
+
+// Return whether or not the operation may be attempted for the key.
+func (b *Backoff) Ready(key string) bool {
+	return !time.Now().Before(b.next[key])
+}
+
+// Record a failed attempt for the key, and return the delay before the next
+// attempt.
+func (b *Backoff) Fail(key string) time.Duration {
+	delay := b.base
+	for i := 0; i < b.failures[key] && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.failures[key]++
+	b.next[key] = time.Now().Add(delay)
+	return delay
+}
+
+// Record a successful attempt for the key, resetting its backoff.
+func (b *Backoff) Succeed(key string) {
+	delete(b.failures, key)
+	delete(b.next, key)
+}
+
+// Return the number of consecutive failed attempts for the key.
+func (b *Backoff) Failures(key string) int {
+	return b.failures[key]
+}
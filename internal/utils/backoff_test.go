@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 5*time.Second)
+	if !b.Ready("a") {
+		t.Fatal("Ready() = false before any failure")
+	}
+
+	for _, want := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	} {
+		if delay := b.Fail("a"); delay != want {
+			t.Fatalf("Fail() = %s, want %s", delay, want)
+		}
+	}
+	if b.Failures("a") != 5 {
+		t.Fatalf("Failures() = %d, want 5", b.Failures("a"))
+	}
+	if b.Ready("a") {
+		t.Fatal("Ready() = true while backing off")
+	}
+	if !b.Ready("b") {
+		t.Fatal("Ready() = false for another key")
+	}
+
+	b.Succeed("a")
+	if !b.Ready("a") || b.Failures("a") != 0 {
+		t.Fatal("Succeed() did not reset the backoff")
+	}
+	if delay := b.Fail("a"); delay != time.Second {
+		t.Fatalf("Fail() = %s after success, want %s", delay, time.Second)
+	}
+}